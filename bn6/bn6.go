@@ -18,11 +18,12 @@ func Load(romTitle string) *BN6 {
 	return &BN6{offsets}
 }
 
-func (b *BN6) StartBattleFromCommMenu(core *mgba.Core) {
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x0, -1, 0x18)
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x1, -1, 0x18)
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x2, -1, 0x00)
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x3, -1, 0x00)
+func (b *BN6) setMenuControlState(core mgba.Emulator, state [4]uint8) {
+	mustWriteField(core, b.Offsets.EWRAM.A_MenuControl, &MenuControl{State: state}, "State")
+}
+
+func (b *BN6) StartBattleFromCommMenu(core mgba.Emulator) {
+	b.setMenuControlState(core, [4]uint8{0x18, 0x18, 0x00, 0x00})
 }
 
 type DropMatchmakingType int
@@ -32,67 +33,65 @@ const (
 	DropMatchmakingTypeWrongMode                           = 0x25
 )
 
-func (b *BN6) DropMatchmakingFromCommMenu(core *mgba.Core, typ DropMatchmakingType) {
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x0, -1, 0x18)
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x1, -1, 0x3c)
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x2, -1, 0x04)
-	core.RawWrite8(b.Offsets.EWRAM.A_MenuControl+0x3, -1, 0x04)
+func (b *BN6) DropMatchmakingFromCommMenu(core mgba.Emulator, typ DropMatchmakingType) {
+	b.setMenuControlState(core, [4]uint8{0x18, 0x3c, 0x04, 0x04})
 	if typ != 0 {
-		core.GBA().SetRegister(0, uint32(typ))
-		core.GBA().SetRegister(15, b.Offsets.ROM.A_commMenu_run_chatbox_script__entry)
-		core.GBA().ThumbWritePC()
+		core.SetRegister(0, uint32(typ))
+		core.SetRegister(15, b.Offsets.ROM.A_commMenu_run_chatbox_script__entry)
+		core.ThumbWritePC()
 	}
 }
 
-func (b *BN6) LocalJoyflags(core *mgba.Core) uint16 {
-	return core.RawRead16(b.Offsets.EWRAM.A_Joypad+0x00, -1)
+func (b *BN6) LocalJoyflags(core mgba.Emulator) uint16 {
+	return core.RawRead16(b.Offsets.EWRAM.A_Joypad+joypadJoyflagsOffset, -1)
 }
 
-func (b *BN6) LocalCustomScreenState(core *mgba.Core) uint8 {
-	return core.RawRead8(b.Offsets.EWRAM.A_BattleState+0x11, -1)
+func (b *BN6) LocalCustomScreenState(core mgba.Emulator) uint8 {
+	return core.RawRead8(b.Offsets.EWRAM.A_BattleState+battleStateLocalCustomScreenStateOffset, -1)
 }
 
-func (b *BN6) LocalMarshaledBattleState(core *mgba.Core) []byte {
+func (b *BN6) LocalMarshaledBattleState(core mgba.Emulator) []byte {
 	var buf [0x100]byte
 	core.RawReadRange(b.Offsets.EWRAM.A_LocalMarshaledBattleState, -1, buf[:])
 	return buf[:]
 }
 
-func (b *BN6) SetPlayerInputState(core *mgba.Core, index int, keysPressed uint16, customScreenState uint8) {
-	ePlayerInput := b.Offsets.EWRAM.A_PlayerInputDataArr + uint32(index)*0x08
-	keysHeld := core.RawRead16(ePlayerInput+0x02, -1)
-	core.RawWrite16(ePlayerInput+0x02, -1, keysPressed)
-	core.RawWrite16(ePlayerInput+0x04, -1, ^keysHeld&keysPressed)
-	core.RawWrite16(ePlayerInput+0x06, -1, keysHeld&^keysPressed)
-	core.RawWrite8(b.Offsets.EWRAM.A_BattleState+0x14+uint32(index), -1, customScreenState)
+func (b *BN6) SetPlayerInputState(core mgba.Emulator, index int, keysPressed uint16, customScreenState uint8) {
+	address := b.playerInputAddress(index)
+	keysHeld := core.RawRead16(address+playerInputKeysHeldOffset, -1)
+	core.RawWrite16(address+playerInputKeysHeldOffset, -1, keysPressed)
+	core.RawWrite16(address+playerInputKeysJustPressedOffset, -1, ^keysHeld&keysPressed)
+	core.RawWrite16(address+playerInputKeysJustReleasedOffset, -1, keysHeld&^keysPressed)
+
+	core.RawWrite8(b.Offsets.EWRAM.A_BattleState+battleStatePlayerCustomScreenStatesOffset+uint32(index), -1, customScreenState)
 }
 
-func (b *BN6) SetPlayerMarshaledBattleState(core *mgba.Core, index int, marshaledState []byte) {
+func (b *BN6) SetPlayerMarshaledBattleState(core mgba.Emulator, index int, marshaledState []byte) {
 	core.RawWriteRange(b.Offsets.EWRAM.A_PlayerMarshaledStateArr+uint32(index)*0x100, -1, marshaledState)
 }
 
-func (b *BN6) LocalWins(core *mgba.Core) uint8 {
-	return core.RawRead8(b.Offsets.EWRAM.A_BattleState+0x18, -1)
+func (b *BN6) LocalWins(core mgba.Emulator) uint8 {
+	return b.BattleState(core).LocalWins
 }
 
-func (b *BN6) RemoteWins(core *mgba.Core) uint8 {
-	return core.RawRead8(b.Offsets.EWRAM.A_BattleState+0x19, -1)
+func (b *BN6) RemoteWins(core mgba.Emulator) uint8 {
+	return b.BattleState(core).RemoteWins
 }
 
-func (b *BN6) RNG2State(core *mgba.Core) uint32 {
+func (b *BN6) RNG2State(core mgba.Emulator) uint32 {
 	return core.RawRead32(b.Offsets.EWRAM.A_Rng2, -1)
 }
 
-func (b *BN6) MenuControlState(core *mgba.Core, offset uint32) uint8 {
-	return core.RawRead8(b.Offsets.EWRAM.A_MenuControl+offset, -1)
+func (b *BN6) MenuControlState(core mgba.Emulator) [4]uint8 {
+	return b.MenuControl(core).State
 }
 
-func (b *BN6) SetLinkBattleSettingsAndBackground(core *mgba.Core, linkBattleSettingsAndBackground uint16) {
-	core.RawWrite16(b.Offsets.EWRAM.A_MenuControl+0x2a, -1, linkBattleSettingsAndBackground)
+func (b *BN6) SetLinkBattleSettingsAndBackground(core mgba.Emulator, linkBattleSettingsAndBackground uint16) {
+	mustWriteField(core, b.Offsets.EWRAM.A_MenuControl, &MenuControl{LinkBattleSettingsAndBackground: linkBattleSettingsAndBackground}, "LinkBattleSettingsAndBackground")
 }
 
-func (b *BN6) MatchType(core *mgba.Core) uint16 {
-	return core.RawRead16(b.Offsets.EWRAM.A_MenuControl+0x12, -1)
+func (b *BN6) MatchType(core mgba.Emulator) uint16 {
+	return b.MenuControl(core).MatchType
 }
 
 var battleBackgrounds = []uint16{
@@ -119,6 +118,6 @@ func (b *BN6) RandomBattleSettingsAndBackground(randSource rand.Source, matchTyp
 	return uint16(hi<<0x8 | lo)
 }
 
-func (b *BN6) InBattleTime(core *mgba.Core) uint32 {
-	return core.RawRead32(b.Offsets.EWRAM.A_BattleState+0x60, -1)
+func (b *BN6) InBattleTime(core mgba.Emulator) uint32 {
+	return core.RawRead32(b.Offsets.EWRAM.A_BattleState+battleStateInBattleTimeOffset, -1)
 }
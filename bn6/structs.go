@@ -0,0 +1,119 @@
+package bn6
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/murkland/tango/mgba"
+)
+
+// BattleState is the state of the battle currently in progress, at A_BattleState.
+type BattleState struct {
+	LocalCustomScreenState   uint8    `mem:"0x11"`
+	PlayerCustomScreenStates [2]uint8 `mem:"0x14"`
+	LocalWins                uint8    `mem:"0x18"`
+	RemoteWins               uint8    `mem:"0x19"`
+	InBattleTime             uint32   `mem:"0x60"`
+}
+
+// MenuControl is the state of the menu currently open, at A_MenuControl.
+type MenuControl struct {
+	// State is the menu's state machine: the menu, then the submenu, then two more levels of substate.
+	State                           [4]uint8 `mem:"0x00"`
+	MatchType                       uint16   `mem:"0x12"`
+	LinkBattleSettingsAndBackground uint16   `mem:"0x2a"`
+}
+
+// PlayerInput is the input a player made on the current frame of a battle. There is one for each player, starting at A_PlayerInputDataArr.
+type PlayerInput struct {
+	KeysHeld         uint16 `mem:"0x02"`
+	KeysJustPressed  uint16 `mem:"0x04"`
+	KeysJustReleased uint16 `mem:"0x06"`
+}
+
+const playerInputSize = 0x08
+
+// Joypad is the state of the local joypad, at A_Joypad.
+type Joypad struct {
+	Joyflags uint16 `mem:"0x00"`
+}
+
+// The layouts above are all fixed, so any error from reading or writing them is a bug.
+
+// Fields that are read or written on every frame, even while fastforwarding, are accessed directly at these offsets instead of going through reflection each time.
+var (
+	battleStateLocalCustomScreenStateOffset   = mustFieldOffset(BattleState{}, "LocalCustomScreenState")
+	battleStatePlayerCustomScreenStatesOffset = mustFieldOffset(BattleState{}, "PlayerCustomScreenStates")
+	battleStateInBattleTimeOffset             = mustFieldOffset(BattleState{}, "InBattleTime")
+	playerInputKeysHeldOffset                 = mustFieldOffset(PlayerInput{}, "KeysHeld")
+	playerInputKeysJustPressedOffset          = mustFieldOffset(PlayerInput{}, "KeysJustPressed")
+	playerInputKeysJustReleasedOffset         = mustFieldOffset(PlayerInput{}, "KeysJustReleased")
+	joypadJoyflagsOffset                      = mustFieldOffset(Joypad{}, "Joyflags")
+)
+
+func mustFieldOffset(v interface{}, name string) uint32 {
+	l, err := mgba.LayoutOf(reflect.TypeOf(v))
+	if err != nil {
+		panic(err)
+	}
+	f, ok := l.Field(name)
+	if !ok {
+		panic(fmt.Sprintf("%s has no field %q", l.Name, name))
+	}
+	return f.Offset
+}
+
+func mustReadStruct(core mgba.Emulator, address uint32, v interface{}) {
+	if err := mgba.ReadStruct(core, address, v); err != nil {
+		panic(err)
+	}
+}
+
+func mustWriteField(core mgba.Emulator, address uint32, v interface{}, name string) {
+	if err := mgba.WriteField(core, address, v, name); err != nil {
+		panic(err)
+	}
+}
+
+func (b *BN6) BattleState(core mgba.Emulator) BattleState {
+	var s BattleState
+	mustReadStruct(core, b.Offsets.EWRAM.A_BattleState, &s)
+	return s
+}
+
+func (b *BN6) MenuControl(core mgba.Emulator) MenuControl {
+	var s MenuControl
+	mustReadStruct(core, b.Offsets.EWRAM.A_MenuControl, &s)
+	return s
+}
+
+func (b *BN6) PlayerInput(core mgba.Emulator, index int) PlayerInput {
+	var s PlayerInput
+	mustReadStruct(core, b.playerInputAddress(index), &s)
+	return s
+}
+
+func (b *BN6) Joypad(core mgba.Emulator) Joypad {
+	var s Joypad
+	mustReadStruct(core, b.Offsets.EWRAM.A_Joypad, &s)
+	return s
+}
+
+func (b *BN6) playerInputAddress(index int) uint32 {
+	return b.Offsets.EWRAM.A_PlayerInputDataArr + uint32(index)*playerInputSize
+}
+
+// DumpState formats every struct this package knows the layout of, for debugging.
+func (b *BN6) DumpState(core mgba.Emulator) string {
+	battleState := b.BattleState(core)
+	menuControl := b.MenuControl(core)
+	joypad := b.Joypad(core)
+	s := mgba.FormatStruct(b.Offsets.EWRAM.A_BattleState, &battleState) +
+		mgba.FormatStruct(b.Offsets.EWRAM.A_MenuControl, &menuControl) +
+		mgba.FormatStruct(b.Offsets.EWRAM.A_Joypad, &joypad)
+	for i := 0; i < 2; i++ {
+		playerInput := b.PlayerInput(core, i)
+		s += mgba.FormatStruct(b.playerInputAddress(i), &playerInput)
+	}
+	return s
+}
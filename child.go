@@ -143,7 +143,7 @@ func childMain() {
 	ebiten.SetWindowResizable(true)
 	ebiten.SetRunnableOnUnfocused(true)
 
-	g, err := game.New(conf, p, *romPath)
+	g, err := game.New(conf, p, version, *romPath)
 	if err != nil {
 		log.Panicf("failed to start game: %s", err)
 	}
@@ -10,23 +10,63 @@ import (
 )
 
 type Keymapping struct {
-	A         Key
-	B         Key
-	L         Key
-	R         Key
-	Left      Key
-	Right     Key
-	Up        Key
-	Down      Key
-	Start     Key
-	Select    Key
-	DebugSpew Key
+	A             Key
+	B             Key
+	L             Key
+	R             Key
+	Left          Key
+	Right         Key
+	Up            Key
+	Down          Key
+	Start         Key
+	Select        Key
+	DebugSpew     Key
+	InputDisplay  Key
+	Turbo         Key
+	SlowMotion    Key
+	SaveState     Key
+	LoadState     Key
+	PrevStateSlot Key
+	NextStateSlot Key
+	Rewind        Key
+}
+
+type Speed struct {
+	// Turbo is how many times faster than normal the game runs while the turbo key is held, or 0 to run as fast as it can. If it is less than 0, the default is used.
+	Turbo float32
+
+	// SlowMotion is how fast the game runs while the slow motion key is held, as a fraction of normal speed. It must be more than 0, otherwise the default is used.
+	SlowMotion float32
+}
+
+type Rewind struct {
+	// Interval is how many frames apart snapshots are taken for rewinding.
+	Interval int
+
+	// Snapshots is how many snapshots to keep, or 0 to turn rewinding off. Each one takes about 400 KiB of memory.
+	Snapshots int
 }
 
 type Netplay struct {
 	InputDelay int
 }
 
+type Replay struct {
+	// KeyframeInterval is how many ticks apart keyframes are written to replays, or 0 to not write them.
+	KeyframeInterval int
+
+	// SaveMatches also saves every battle of a match together into one match file, alongside the per-battle replays.
+	SaveMatches bool
+}
+
+type Saves struct {
+	// SandboxNetplay runs netplay on an in-memory copy of the save. Afterwards, you are asked whether to keep any changes made to it.
+	SandboxNetplay bool
+
+	// Backups is how many backups of the save to keep, one taken every time the game is started, or 0 to not take any.
+	Backups int
+}
+
 type Matchmaking struct {
 	ConnectAddr string
 }
@@ -68,7 +108,11 @@ func (ait AudioInterpolationType) MarshalText() ([]byte, error) {
 type Config struct {
 	Keymapping  Keymapping
 	Audio       Audio
+	Speed       Speed
+	Rewind      Rewind
 	Netplay     Netplay
+	Replay      Replay
+	Saves       Saves
 	Matchmaking Matchmaking
 	WebRTC      webrtc.Configuration
 }
@@ -76,24 +120,47 @@ type Config struct {
 func Default() Config {
 	return Config{
 		Keymapping: Keymapping{
-			A:         Key(ebiten.KeyZ),
-			B:         Key(ebiten.KeyX),
-			L:         Key(ebiten.KeyA),
-			R:         Key(ebiten.KeyS),
-			Left:      Key(ebiten.KeyArrowLeft),
-			Right:     Key(ebiten.KeyArrowRight),
-			Up:        Key(ebiten.KeyArrowUp),
-			Down:      Key(ebiten.KeyArrowDown),
-			Start:     Key(ebiten.KeyEnter),
-			Select:    Key(ebiten.KeyBackspace),
-			DebugSpew: Key(ebiten.KeyBackquote),
+			A:             Key(ebiten.KeyZ),
+			B:             Key(ebiten.KeyX),
+			L:             Key(ebiten.KeyA),
+			R:             Key(ebiten.KeyS),
+			Left:          Key(ebiten.KeyArrowLeft),
+			Right:         Key(ebiten.KeyArrowRight),
+			Up:            Key(ebiten.KeyArrowUp),
+			Down:          Key(ebiten.KeyArrowDown),
+			Start:         Key(ebiten.KeyEnter),
+			Select:        Key(ebiten.KeyBackspace),
+			DebugSpew:     Key(ebiten.KeyBackquote),
+			InputDisplay:  Key(ebiten.KeyF3),
+			Turbo:         Key(ebiten.KeyTab),
+			SlowMotion:    Key(ebiten.KeyBackslash),
+			SaveState:     Key(ebiten.KeyF5),
+			LoadState:     Key(ebiten.KeyF8),
+			PrevStateSlot: Key(ebiten.KeyF6),
+			NextStateSlot: Key(ebiten.KeyF7),
+			Rewind:        Key(ebiten.KeyQ),
 		},
 		Audio: Audio{
 			Interpolation: AudioInterpolationTypeClippy,
 		},
+		Speed: Speed{
+			Turbo:      4,
+			SlowMotion: 0.5,
+		},
+		Rewind: Rewind{
+			Interval:  10,
+			Snapshots: 120,
+		},
 		Netplay: Netplay{
 			InputDelay: 3,
 		},
+		Replay: Replay{
+			KeyframeInterval: 600,
+		},
+		Saves: Saves{
+			SandboxNetplay: true,
+			Backups:        5,
+		},
 		Matchmaking: Matchmaking{
 			ConnectAddr: "mm.tango.murk.land:80",
 		},
@@ -130,5 +197,13 @@ func Load(r io.Reader) (Config, error) {
 		return c, err
 	}
 
+	// A turbo of 0 means uncapped, but a negative speed doesn't mean anything.
+	if c.Speed.Turbo < 0 {
+		c.Speed.Turbo = Default().Speed.Turbo
+	}
+	if c.Speed.SlowMotion <= 0 {
+		c.Speed.SlowMotion = Default().Speed.SlowMotion
+	}
+
 	return c, nil
 }
@@ -14,7 +14,7 @@ import (
 )
 
 type Fastforwarder struct {
-	core                    *mgba.Core
+	core                    mgba.Emulator
 	bn6                     *bn6.BN6
 	state                   *fastforwarderState
 	lastFastforwardDuration time.Duration
@@ -24,6 +24,7 @@ type fastforwarderState struct {
 	err              error
 	localPlayerIndex int
 	inputPairs       *ringbuf.RingBuf[[2]input.Input]
+	startTime        int
 	commitTime       int
 	committedState   *mgba.State
 	dirtyTime        int
@@ -36,13 +37,24 @@ func NewFastforwarder(romPath string, bn6 *bn6.BN6) (*Fastforwarder, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewFastforwarderWithEmulator(core, bn6), nil
+}
 
+// NewFastforwarderWithEmulator makes a fastforwarder that runs on the given emulator, which must not be used for anything else.
+func NewFastforwarderWithEmulator(core mgba.Emulator, bn6 *bn6.BN6) *Fastforwarder {
 	ff := &Fastforwarder{core, bn6, nil, 0}
 
-	tp := mgba.NewTrapper(core)
-
-	tp.Add(bn6.Offsets.ROM.A_main__readJoyflags, func() {
+	core.AddTrap(bn6.Offsets.ROM.A_main__readJoyflags, func() {
 		inBattleTime := int(ff.bn6.InBattleTime(ff.core))
+
+		// Only ticks that are being committed this time get keyframes, so each keyframe is written exactly once.
+		if interval := ff.state.rw.KeyframeInterval(); interval > 0 && inBattleTime%interval == 0 && inBattleTime >= ff.state.startTime && inBattleTime < ff.state.commitTime {
+			if err := ff.state.rw.WriteKeyframe(inBattleTime, core.SaveState()); err != nil {
+				ff.state.err = err
+				return
+			}
+		}
+
 		if inBattleTime == ff.state.commitTime {
 			ff.state.committedState = core.SaveState()
 		}
@@ -69,17 +81,17 @@ func NewFastforwarder(romPath string, bn6 *bn6.BN6) (*Fastforwarder, error) {
 			return
 		}
 
-		core.GBA().SetRegister(4, uint32(ip[ff.state.localPlayerIndex].Joyflags))
+		core.SetRegister(4, uint32(ip[ff.state.localPlayerIndex].Joyflags))
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_battle_update__call__battle_copyInputData, func() {
+	core.AddTrap(bn6.Offsets.ROM.A_battle_update__call__battle_copyInputData, func() {
 		if ff.state.inputPairs.Used() == 0 {
 			return
 		}
 
-		core.GBA().SetRegister(0, 0)
-		core.GBA().SetRegister(15, core.GBA().Register(15)+4)
-		core.GBA().ThumbWritePC()
+		core.SetRegister(0, 0)
+		core.SetRegister(15, core.Register(15)+4)
+		core.ThumbWritePC()
 
 		var inputPairBuf [1][2]input.Input
 		ff.state.inputPairs.Pop(inputPairBuf[:], 0)
@@ -111,28 +123,26 @@ func NewFastforwarder(romPath string, bn6 *bn6.BN6) (*Fastforwarder, error) {
 		}
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_battle_isP2__tst, func() {
-		core.GBA().SetRegister(0, uint32(ff.state.localPlayerIndex))
+	core.AddTrap(bn6.Offsets.ROM.A_battle_isP2__tst, func() {
+		core.SetRegister(0, uint32(ff.state.localPlayerIndex))
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_link_isP2__ret, func() {
-		core.GBA().SetRegister(0, uint32(ff.state.localPlayerIndex))
+	core.AddTrap(bn6.Offsets.ROM.A_link_isP2__ret, func() {
+		core.SetRegister(0, uint32(ff.state.localPlayerIndex))
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_commMenu_inBattle__call__commMenu_handleLinkCableInput, func() {
-		core.GBA().SetRegister(15, core.GBA().Register(15)+4)
-		core.GBA().ThumbWritePC()
+	core.AddTrap(bn6.Offsets.ROM.A_commMenu_inBattle__call__commMenu_handleLinkCableInput, func() {
+		core.SetRegister(15, core.Register(15)+4)
+		core.ThumbWritePC()
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_getCopyDataInputState__ret, func() {
-		core.GBA().SetRegister(0, 2)
+	core.AddTrap(bn6.Offsets.ROM.A_getCopyDataInputState__ret, func() {
+		core.SetRegister(0, 2)
 	})
 
-	tp.Attach(core.GBA())
-
 	core.Reset()
 
-	return ff, nil
+	return ff
 }
 
 // Fastforward fastfowards the state to the new state.
@@ -170,12 +180,13 @@ func (ff *Fastforwarder) Fastforward(state *mgba.State, rw *replay.Writer, local
 	inputPairs = append(inputPairs, predictedInputPairs...)
 
 	// Rewind state to a point where inputs can be applied safely.
-	ff.core.GBA().SetRegister(15, ff.bn6.Offsets.ROM.A_main__readJoyflags)
-	ff.core.GBA().ThumbWritePC()
+	ff.core.SetRegister(15, ff.bn6.Offsets.ROM.A_main__readJoyflags)
+	ff.core.ThumbWritePC()
 
 	ff.state = &fastforwarderState{
 		localPlayerIndex: localPlayerIndex,
 		inputPairs:       ringbuf.New[[2]input.Input](len(inputPairs)),
+		startTime:        startInBattleTime,
 		commitTime:       commitTime,
 		dirtyTime:        startInBattleTime + len(inputPairs) - 1,
 		rw:               rw,
@@ -0,0 +1,395 @@
+package game
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/murkland/tango/bn6"
+	"github.com/murkland/tango/input"
+	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/mgba/fake"
+	"github.com/murkland/tango/replay"
+)
+
+// fakeROMTitle is a supported game, so the fake game can use its offsets.
+const fakeROMTitle = "MEGAMAN6_FXX"
+
+// fakeStepAddr is where the fake game runs a frame of its battle. It isn't an address any real code is at.
+const fakeStepAddr = 0x08fffff0
+
+// newFakeGame makes a fake core that runs a tiny stand-in for a battle. Each frame, it reads the joypad, copies the players' inputs, then mixes both players' held keys and custom screen states into the RNG and moves on to the next tick.
+//
+// The RNG state depends on every input that was ever applied, so two runs only end up with the same RNG state if they applied the same inputs.
+func newFakeGame() (*fake.Core, *bn6.BN6) {
+	b := bn6.Load(fakeROMTitle)
+	addrs := []uint32{
+		b.Offsets.ROM.A_main__readJoyflags,
+		b.Offsets.ROM.A_battle_update__call__battle_copyInputData,
+		fakeStepAddr,
+	}
+	core := fake.New(fakeROMTitle, 0x12345678, func(frame int) []uint32 {
+		return addrs
+	})
+
+	core.AddTrap(fakeStepAddr, func() {
+		battleState := b.BattleState(core)
+
+		rng := b.RNG2State(core)
+		for i := 0; i < 2; i++ {
+			rng = rng*0x41c64e6d + 0x3039 + uint32(b.PlayerInput(core, i).KeysHeld)
+			rng = rng*0x41c64e6d + 0x3039 + uint32(battleState.PlayerCustomScreenStates[i])
+		}
+		core.RawWrite32(b.Offsets.EWRAM.A_Rng2, -1, rng)
+
+		if err := mgba.WriteField(core, b.Offsets.EWRAM.A_BattleState, &bn6.BattleState{InBattleTime: battleState.InBattleTime + 1}, "InBattleTime"); err != nil {
+			panic(err)
+		}
+	})
+
+	return core, b
+}
+
+// fakeTurn is the turn data committed at the given tick.
+func fakeTurn(tick int) []byte {
+	turn := make([]byte, 0x100)
+	for i := range turn {
+		turn[i] = uint8(tick + i)
+	}
+	return turn
+}
+
+// fakeInputPairs makes n ticks of input pairs, starting from tick 0. P1 commits a turn every 100 ticks, from tick 50.
+func fakeInputPairs(n int) [][2]input.Input {
+	inputPairs := make([][2]input.Input, n)
+	for i := range inputPairs {
+		for p := 0; p < 2; p++ {
+			inputPairs[i][p] = input.Input{
+				LocalTick:         i,
+				RemoteTick:        i,
+				Joyflags:          0xfc00 | uint16((i*(37+p*11))%0x400),
+				CustomScreenState: uint8((i/30 + p) % 2),
+			}
+		}
+		if i%100 == 50 {
+			inputPairs[i][0].Turn = fakeTurn(i)
+		}
+	}
+	return inputPairs
+}
+
+// newTestWriter opens a replay writer in a temporary directory and writes everything that goes before the first tick.
+func newTestWriter(t *testing.T, state *mgba.State, keyframeInterval int) (*replay.Writer, string) {
+	path := filepath.Join(t.TempDir(), "test.tangoreplay")
+	rw, err := replay.NewWriter(path, keyframeInterval)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+
+	if err := rw.WriteMetadata(replay.Metadata{ROMTitle: fakeROMTitle, ROMCRC32: 0x12345678}); err != nil {
+		t.Fatalf("WriteMetadata: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := rw.WriteInit(i, make([]byte, 0x100)); err != nil {
+			t.Fatalf("WriteInit: %s", err)
+		}
+	}
+	if err := rw.WriteState(0, state); err != nil {
+		t.Fatalf("WriteState: %s", err)
+	}
+	return rw, path
+}
+
+// recordReplay commits all of the input pairs in one go and writes them to a replay file, with a keyframe every keyframeInterval ticks.
+func recordReplay(t *testing.T, inputPairs [][2]input.Input, keyframeInterval int) string {
+	core, b := newFakeGame()
+	ff := NewFastforwarderWithEmulator(core, b)
+
+	state := core.SaveState()
+	rw, path := newTestWriter(t, state, keyframeInterval)
+
+	if _, _, _, err := ff.Fastforward(state, rw, 0, inputPairs, input.Input{}, nil); err != nil {
+		t.Fatalf("Fastforward: %s", err)
+	}
+
+	if err := rw.WriteResult(replay.ResultWin); err != nil {
+		t.Fatalf("WriteResult: %s", err)
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	return path
+}
+
+// readTestReplay reads every tick of a replay file.
+func readTestReplay(t *testing.T, path string) []replay.Tick {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer f.Close()
+
+	rr, err := replay.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer rr.Close()
+
+	var ticks []replay.Tick
+	for {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatalf("Next: %s", err)
+		}
+		ticks = append(ticks, tick)
+	}
+	return ticks
+}
+
+// referenceRNGStates runs the fake game on its own, applying the input pairs directly, and returns the RNG state at the start of each tick and after the last one.
+func referenceRNGStates(inputPairs [][2]input.Input) []uint32 {
+	core, b := newFakeGame()
+	core.Reset()
+
+	core.AddTrap(b.Offsets.ROM.A_battle_update__call__battle_copyInputData, func() {
+		ip := inputPairs[b.InBattleTime(core)]
+		for i := 0; i < 2; i++ {
+			b.SetPlayerInputState(core, i, ip[i].Joyflags, ip[i].CustomScreenState)
+		}
+	})
+
+	rngStates := make([]uint32, 0, len(inputPairs)+1)
+	for range inputPairs {
+		rngStates = append(rngStates, b.RNG2State(core))
+		core.RunFrame()
+	}
+	return append(rngStates, b.RNG2State(core))
+}
+
+func TestFastforwardCommitsOnlyCommittedInputs(t *testing.T) {
+	inputPairs := fakeInputPairs(40)
+	reference := referenceRNGStates(inputPairs)
+
+	core, b := newFakeGame()
+	ff := NewFastforwarderWithEmulator(core, b)
+	rw, path := newTestWriter(t, core.SaveState(), 0)
+
+	// Commit 10 ticks, and predict 5 more past them.
+	const committed = 10
+	const predicted = 5
+	localInputsLeft := make([]input.Input, predicted)
+	for i := range localInputsLeft {
+		localInputsLeft[i] = inputPairs[committed+i][0]
+	}
+	lastCommittedRemoteInput := inputPairs[committed-1][1]
+
+	committedState, dirtyState, lastInputPair, err := ff.Fastforward(core.SaveState(), rw, 0, inputPairs[:committed:committed], lastCommittedRemoteInput, localInputsLeft)
+	if err != nil {
+		t.Fatalf("Fastforward: %s", err)
+	}
+	if err := rw.WriteResult(replay.ResultWin); err != nil {
+		t.Fatalf("WriteResult: %s", err)
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// The committed state is exactly where applying the committed inputs gets to.
+	core.LoadState(committedState)
+	if tick := int(b.InBattleTime(core)); tick != committed {
+		t.Errorf("committed state is at tick %d, want %d", tick, committed)
+	}
+	if rng := b.RNG2State(core); rng != reference[committed] {
+		t.Errorf("committed state rng = %08x, want %08x", rng, reference[committed])
+	}
+
+	// The remote player's predicted inputs only keep A and B held, and the custom screen state, from their last committed input.
+	wantPredicted := input.Input{
+		LocalTick:         committed + predicted - 1,
+		RemoteTick:        committed + predicted - 1,
+		Joyflags:          lastCommittedRemoteInput.Joyflags & uint16(mgba.KeysA|mgba.KeysB),
+		CustomScreenState: lastCommittedRemoteInput.CustomScreenState,
+	}
+	if got, want := lastInputPair[0], localInputsLeft[predicted-1]; got.LocalTick != want.LocalTick || got.Joyflags != want.Joyflags || got.CustomScreenState != want.CustomScreenState {
+		t.Errorf("last local input = %+v, want %+v", got, want)
+	}
+	if got := lastInputPair[1]; got.LocalTick != wantPredicted.LocalTick || got.RemoteTick != wantPredicted.RemoteTick || got.Joyflags != wantPredicted.Joyflags || got.CustomScreenState != wantPredicted.CustomScreenState || got.Turn != nil {
+		t.Errorf("last remote input = %+v, want %+v", got, wantPredicted)
+	}
+
+	// The dirty state has had every input but the last applied, and the predicted ones are what it ran on.
+	core.LoadState(dirtyState)
+	if tick := int(b.InBattleTime(core)); tick != committed+predicted-1 {
+		t.Errorf("dirty state is at tick %d, want %d", tick, committed+predicted-1)
+	}
+	if keysHeld := b.PlayerInput(core, 1).KeysHeld; keysHeld != wantPredicted.Joyflags {
+		t.Errorf("dirty state remote keys held = %04x, want %04x", keysHeld, wantPredicted.Joyflags)
+	}
+	if keysHeld := b.PlayerInput(core, 0).KeysHeld; keysHeld != localInputsLeft[predicted-2].Joyflags {
+		t.Errorf("dirty state local keys held = %04x, want %04x", keysHeld, localInputsLeft[predicted-2].Joyflags)
+	}
+
+	// Only the committed inputs make it into the replay.
+	ticks := readTestReplay(t, path)
+	if len(ticks) != committed {
+		t.Fatalf("replay has %d ticks, want %d", len(ticks), committed)
+	}
+	for i, tick := range ticks {
+		if tick.InputPair[0].Joyflags != inputPairs[i][0].Joyflags || tick.InputPair[1].Joyflags != inputPairs[i][1].Joyflags {
+			t.Errorf("replay tick %d has joyflags %04x/%04x, want %04x/%04x", i, tick.InputPair[0].Joyflags, tick.InputPair[1].Joyflags, inputPairs[i][0].Joyflags, inputPairs[i][1].Joyflags)
+		}
+		if tick.RNGState != reference[i] {
+			t.Errorf("replay tick %d rng = %08x, want %08x", i, tick.RNGState, reference[i])
+		}
+	}
+}
+
+func TestFastforwardRollbackDepth(t *testing.T) {
+	inputPairs := fakeInputPairs(60)
+	reference := referenceRNGStates(inputPairs)
+
+	for depth := 1; depth <= 8; depth++ {
+		core, b := newFakeGame()
+		ff := NewFastforwarderWithEmulator(core, b)
+		rw, _ := newTestWriter(t, core.SaveState(), 0)
+
+		// Commit one tick at a time, always predicting depth ticks ahead, as a real battle with that much lag would. Fastforward appends the predictions to the committed inputs, so they're capped to keep it from writing over the inputs after them.
+		state := core.SaveState()
+		lastCommittedRemoteInput := input.Input{Joyflags: 0xfc00}
+		for tick := 0; tick+depth < len(inputPairs); tick++ {
+			localInputsLeft := make([]input.Input, depth)
+			for i := range localInputsLeft {
+				localInputsLeft[i] = inputPairs[tick+1+i][0]
+			}
+
+			committedState, dirtyState, _, err := ff.Fastforward(state, rw, 0, inputPairs[tick:tick+1:tick+1], lastCommittedRemoteInput, localInputsLeft)
+			if err != nil {
+				t.Fatalf("depth %d, tick %d: Fastforward: %s", depth, tick, err)
+			}
+
+			core.LoadState(committedState)
+			if got := int(b.InBattleTime(core)); got != tick+1 {
+				t.Fatalf("depth %d, tick %d: committed state is at tick %d, want %d", depth, tick, got, tick+1)
+			}
+			if rng := b.RNG2State(core); rng != reference[tick+1] {
+				t.Fatalf("depth %d, tick %d: committed state rng = %08x, want %08x", depth, tick, rng, reference[tick+1])
+			}
+
+			core.LoadState(dirtyState)
+			if got := int(b.InBattleTime(core)); got != tick+depth {
+				t.Fatalf("depth %d, tick %d: dirty state is at tick %d, want %d", depth, tick, got, tick+depth)
+			}
+
+			state = committedState
+			lastCommittedRemoteInput = inputPairs[tick][1]
+		}
+
+		if err := rw.Close(); err != nil {
+			t.Fatalf("depth %d: Close: %s", depth, err)
+		}
+	}
+}
+
+func TestFastforwardKeyframes(t *testing.T) {
+	const keyframeInterval = 10
+	const depth = 4
+	inputPairs := fakeInputPairs(55)
+	reference := referenceRNGStates(inputPairs)
+
+	core, b := newFakeGame()
+	ff := NewFastforwarderWithEmulator(core, b)
+	rw, path := newTestWriter(t, core.SaveState(), keyframeInterval)
+
+	// Commit a few ticks at a time with predictions past them, so every keyframe tick is run more than once.
+	state := core.SaveState()
+	lastCommittedRemoteInput := input.Input{Joyflags: 0xfc00}
+	for tick := 0; tick < len(inputPairs)-depth; tick += 3 {
+		end := tick + 3
+		if end > len(inputPairs)-depth {
+			end = len(inputPairs) - depth
+		}
+
+		localInputsLeft := make([]input.Input, depth)
+		for i := range localInputsLeft {
+			localInputsLeft[i] = inputPairs[end+i][0]
+		}
+
+		committedState, _, _, err := ff.Fastforward(state, rw, 0, inputPairs[tick:end:end], lastCommittedRemoteInput, localInputsLeft)
+		if err != nil {
+			t.Fatalf("tick %d: Fastforward: %s", tick, err)
+		}
+		state = committedState
+		lastCommittedRemoteInput = inputPairs[end-1][1]
+	}
+
+	if err := rw.WriteResult(replay.ResultWin); err != nil {
+		t.Fatalf("WriteResult: %s", err)
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	ticks := readTestReplay(t, path)
+	if len(ticks) != len(inputPairs)-depth {
+		t.Fatalf("replay has %d ticks, want %d", len(ticks), len(inputPairs)-depth)
+	}
+
+	var keyframeTicks []int
+	for i, tick := range ticks {
+		if tick.Keyframe == nil {
+			continue
+		}
+		keyframeTicks = append(keyframeTicks, tick.Keyframe.Tick)
+
+		if tick.Keyframe.Tick != tick.InputPair[0].LocalTick {
+			t.Errorf("keyframe for tick %d is on input for tick %d", tick.Keyframe.Tick, tick.InputPair[0].LocalTick)
+		}
+
+		// A keyframe is the state at the start of its tick, before its inputs are applied.
+		core.LoadState(tick.Keyframe.State)
+		if got := int(b.InBattleTime(core)); got != i {
+			t.Errorf("keyframe for tick %d is at tick %d", i, got)
+		}
+		if rng := b.RNG2State(core); rng != reference[i] {
+			t.Errorf("keyframe for tick %d rng = %08x, want %08x", i, rng, reference[i])
+		}
+	}
+
+	// Each keyframe tick that was committed gets exactly one keyframe, in order.
+	var want []int
+	for tick := 0; tick < len(ticks); tick += keyframeInterval {
+		want = append(want, tick)
+	}
+	if len(keyframeTicks) != len(want) {
+		t.Fatalf("keyframes at ticks %v, want %v", keyframeTicks, want)
+	}
+	for i := range want {
+		if keyframeTicks[i] != want[i] {
+			t.Fatalf("keyframes at ticks %v, want %v", keyframeTicks, want)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer f.Close()
+
+	index, err := replay.ReadIndex(f)
+	if err != nil {
+		t.Fatalf("ReadIndex: %s", err)
+	}
+	if len(index) != len(want) {
+		t.Fatalf("index has %d entries, want %d", len(index), len(want))
+	}
+	for i, entry := range index {
+		if entry.Tick != want[i] {
+			t.Errorf("index entry %d is for tick %d, want %d", i, entry.Tick, want[i])
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
@@ -21,17 +22,30 @@ import (
 	"github.com/murkland/tango/input"
 	"github.com/murkland/tango/match"
 	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/replay"
 	"github.com/ncruces/zenity"
 	"golang.org/x/text/message"
 )
 
 type Game struct {
-	conf config.Config
-	p    *message.Printer
+	conf         config.Config
+	p            *message.Printer
+	tangoVersion string
 
 	mainCore      *mgba.Core
 	fastforwarder *Fastforwarder
 
+	// savePath is where the real save is kept on disk.
+	savePath string
+	// sandboxVF is the in-memory copy of the save that netplay writes to, if the save is sandboxed.
+	sandboxVF *mgba.VFile
+	// sandboxOriginal is what the sandbox held when it was made, to tell whether netplay changed it.
+	sandboxOriginal []byte
+	// saveCommitPending is set once a sandbox with changes in it has ended, until the player has answered whether to keep them.
+	saveCommitPending int32
+	// saveCommitAnswer receives the player's answer while they are being asked whether to keep the sandbox's changes.
+	saveCommitAnswer chan bool
+
 	joyflags mgba.Keys
 
 	bn6 *bn6.BN6
@@ -51,9 +65,29 @@ type Game struct {
 	matchMu sync.Mutex
 
 	debugSpew bool
+
+	inputDisplay     *InputDisplay
+	showInputDisplay bool
+
+	// speed is how many times faster than normal the game is running outside of a match, or 0 if it is uncapped.
+	speed float32
+	// inMatch is whether the speed was last set for a match, in which case netplay is in charge of it.
+	inMatch bool
+
+	romName             string
+	stateSlot           int
+	stateSlotShownUntil time.Time
+	stateSlotThumbnail  *ebiten.Image
+
+	rewind       *rewindBuffer
+	rewindFrames int
+	// rewindState is the snapshot being shown while rewinding, which is held for as long as it took to record it.
+	rewindState  *mgba.State
+	rewinding    int32
+	rewindVolume float64
 }
 
-func New(conf config.Config, p *message.Printer, romPath string) (*Game, error) {
+func New(conf config.Config, p *message.Printer, tangoVersion string, romPath string) (*Game, error) {
 	mainCore, err := newCore(romPath)
 	if err != nil {
 		return nil, err
@@ -62,6 +96,12 @@ func New(conf config.Config, p *message.Printer, romPath string) (*Game, error)
 	romFilename := filepath.Base(romPath)
 	ext := filepath.Ext(romFilename)
 	savePath := filepath.Join("saves", romFilename[:len(romFilename)-len(ext)]+".sav")
+	if conf.Saves.Backups > 0 {
+		if err := backupSave(savePath, conf.Saves.Backups); err != nil {
+			log.Printf("failed to back up save file: %s", err)
+		}
+	}
+
 	saveVF := mgba.OpenVF(savePath, os.O_CREATE|os.O_RDWR)
 	if saveVF == nil {
 		return nil, errors.New("failed to open save file")
@@ -105,12 +145,15 @@ func New(conf config.Config, p *message.Printer, romPath string) (*Game, error)
 	gameAudioPlayer.SetBufferSize(time.Duration(mainCore.AudioBufferSize()+1) * time.Second / time.Duration(mainCore.Options().SampleRate))
 
 	g := &Game{
-		conf: conf,
-		p:    p,
+		conf:         conf,
+		p:            p,
+		tangoVersion: tangoVersion,
 
 		mainCore:      mainCore,
 		fastforwarder: fastforwarder,
 
+		savePath: savePath,
+
 		bn6: bn6,
 
 		vb:    vb,
@@ -120,11 +163,21 @@ func New(conf config.Config, p *message.Printer, romPath string) (*Game, error)
 
 		audioCtx:        audioCtx,
 		gameAudioPlayer: gameAudioPlayer,
+
+		inputDisplay: NewInputDisplay(),
+
+		speed: 1,
+
+		romName: romFilename[:len(romFilename)-len(ext)],
+
+		rewind: newRewindBuffer(conf.Rewind.Snapshots),
 	}
 	g.InstallTraps(mainCore)
 
 	g.t = mgba.NewThread(mainCore)
 	g.t.SetFrameCallback(func() {
+		g.updateRewind()
+
 		g.vbPixMu.Lock()
 		defer g.vbPixMu.Unlock()
 		copy(g.vbPix, g.vb.Pix())
@@ -140,10 +193,13 @@ func New(conf config.Config, p *message.Printer, romPath string) (*Game, error)
 	return g, nil
 }
 
-func (g *Game) InstallTraps(core *mgba.Core) error {
-	tp := mgba.NewTrapper(core)
+// Trapper returns the trapper for the main core, so other hooks can be added alongside the game's own traps.
+func (g *Game) Trapper() *mgba.Trapper {
+	return g.mainCore.Trapper()
+}
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_init__call__battle_copyInputData, func() {
+func (g *Game) InstallTraps(core mgba.Emulator) error {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_init__call__battle_copyInputData, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -154,12 +210,12 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 			log.Panicf("attempting to copy init data while no battle was active!")
 		}
 
-		core.GBA().SetRegister(0, 0x0)
-		core.GBA().SetRegister(15, core.GBA().Register(15)+0x4)
-		core.GBA().ThumbWritePC()
+		core.SetRegister(0, 0x0)
+		core.SetRegister(15, core.Register(15)+0x4)
+		core.ThumbWritePC()
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_init_marshal__ret, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_init_marshal__ret, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -183,7 +239,7 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 		remoteInit, err := m.ReadRemoteInit(ctx)
 		if err != nil {
 			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-				g.mainCore.GBA().Sync().SetFPSTarget(float32(expectedFPS))
+				core.SetFPSTarget(float32(expectedFPS))
 				m.Abort()
 				return
 			}
@@ -193,17 +249,20 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 		log.Printf("init received: remote delay = %d", remoteInit.InputDelay)
 		g.bn6.SetPlayerMarshaledBattleState(core, battle.RemotePlayerIndex(), remoteInit.Marshaled[:])
 
+		battle.SetRemoteDelay(int(remoteInit.InputDelay))
+
+		if err := battle.ReplayWriter().WriteMetadata(m.ReplayMetadata()); err != nil {
+			log.Panicf("failed to write to replay: %s", err)
+		}
 		if err := battle.ReplayWriter().WriteInit(battle.LocalPlayerIndex(), localInit); err != nil {
 			log.Panicf("failed to write to replay: %s", err)
 		}
 		if err := battle.ReplayWriter().WriteInit(battle.RemotePlayerIndex(), remoteInit.Marshaled[:]); err != nil {
 			log.Panicf("failed to write to replay: %s", err)
 		}
-
-		battle.SetRemoteDelay(int(remoteInit.InputDelay))
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_turn_marshal__ret, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_turn_marshal__ret, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -214,11 +273,11 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 			log.Panicf("attempting to marshal turn data while no battle was active!")
 		}
 
-		log.Printf("turn data marshaled on %d", g.bn6.InBattleTime(g.mainCore))
+		log.Printf("turn data marshaled on %d", g.bn6.InBattleTime(core))
 		battle.AddLocalPendingTurn(g.bn6.LocalMarshaledBattleState(core))
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_main__readJoyflags, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_main__readJoyflags, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -239,7 +298,7 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 
 		ctx := context.Background()
 
-		inBattleTime := int(g.bn6.InBattleTime(g.mainCore))
+		inBattleTime := int(g.bn6.InBattleTime(core))
 
 		if battle.CommittedState() == nil {
 			for i := 0; i < battle.LocalDelay(); i++ {
@@ -279,7 +338,7 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 		if err := battle.AddInput(ctx, battle.LocalPlayerIndex(), input.Input{LocalTick: localTick, RemoteTick: remoteTick, Joyflags: joyflags, CustomScreenState: customScreenState, Turn: turn}); err != nil {
 			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
 				log.Printf("could not queue local input within %s, dropping connection", timeout)
-				g.mainCore.GBA().Sync().SetFPSTarget(float32(expectedFPS))
+				core.SetFPSTarget(float32(expectedFPS))
 				m.Abort()
 				return
 			}
@@ -298,29 +357,35 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 		battle.SetCommittedState(committedState)
 		battle.SetLastInput(lastInput)
 
+		for _, ip := range inputPairs {
+			g.inputDisplay.AddConfirmed(ip)
+		}
+		g.inputDisplay.SetCurrent(battle.LocalPlayerIndex(), lastInput[battle.LocalPlayerIndex()].Joyflags, false)
+		g.inputDisplay.SetCurrent(battle.RemotePlayerIndex(), lastInput[battle.RemotePlayerIndex()].Joyflags, len(left) > 0)
+
 		tps := expectedFPS + (remoteTick - localTick - battle.LocalDelay()) - (lastCommittedRemoteInput.RemoteTick - lastCommittedRemoteInput.LocalTick - battle.RemoteDelay())
-		g.mainCore.GBA().Sync().SetFPSTarget(float32(tps))
+		core.SetFPSTarget(float32(tps))
 
-		if !g.mainCore.LoadState(dirtyState) {
+		if !core.LoadState(dirtyState) {
 			log.Panicf("failed to load dirty state")
 		}
 
-		if newInBattleTime := int(g.bn6.InBattleTime(g.mainCore)); newInBattleTime != inBattleTime {
+		if newInBattleTime := int(g.bn6.InBattleTime(core)); newInBattleTime != inBattleTime {
 			log.Panicf("fastforwarder moved battle time: expected %d, got %d", inBattleTime, newInBattleTime)
 		}
 
-		core.GBA().SetRegister(4, uint32(lastInput[battle.LocalPlayerIndex()].Joyflags))
+		core.SetRegister(4, uint32(lastInput[battle.LocalPlayerIndex()].Joyflags))
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_update__call__battle_copyInputData, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_update__call__battle_copyInputData, func() {
 		m := g.Match()
 		if m == nil {
 			return
 		}
 
-		core.GBA().SetRegister(0, 0x0)
-		core.GBA().SetRegister(15, core.GBA().Register(15)+0x4)
-		core.GBA().ThumbWritePC()
+		core.SetRegister(0, 0x0)
+		core.SetRegister(15, core.Register(15)+0x4)
+		core.ThumbWritePC()
 
 		battle := m.Battle()
 		if battle == nil {
@@ -345,7 +410,7 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 		}
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_runUnpausedStep__cmp__retval, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_runUnpausedStep__cmp__retval, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -356,26 +421,30 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 			return
 		}
 
-		switch core.GBA().Register(0) {
+		switch core.Register(0) {
 		case 1:
 			m.SetWonLastBattle(true)
+			battle.SetResult(replay.ResultWin)
 		case 2:
 			m.SetWonLastBattle(false)
+			battle.SetResult(replay.ResultLoss)
 		}
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_start__ret, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_start__ret, func() {
 		m := g.Match()
 		if m == nil {
 			return
 		}
 
-		if err := m.NewBattle(g.mainCore); err != nil {
+		if err := m.NewBattle(core); err != nil {
 			log.Panicf("failed to start new battle: %s", err)
 		}
+
+		g.inputDisplay.Reset()
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_ending__ret, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_ending__ret, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -385,10 +454,10 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 			log.Panicf("failed to end battle: %s", err)
 		}
 
-		g.mainCore.GBA().Sync().SetFPSTarget(float32(expectedFPS))
+		core.SetFPSTarget(float32(expectedFPS))
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_battle_isP2__tst, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_battle_isP2__tst, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -399,10 +468,10 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 			log.Panicf("attempted to get battle p2 information while no battle was active!")
 		}
 
-		core.GBA().SetRegister(0, uint32(battle.LocalPlayerIndex()))
+		core.SetRegister(0, uint32(battle.LocalPlayerIndex()))
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_link_isP2__ret, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_link_isP2__ret, func() {
 		m := g.Match()
 		if m == nil {
 			return
@@ -413,16 +482,16 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 			log.Panicf("attempted to get link p2 information while no battle was active!")
 		}
 
-		core.GBA().SetRegister(0, uint32(battle.LocalPlayerIndex()))
+		core.SetRegister(0, uint32(battle.LocalPlayerIndex()))
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_getCopyDataInputState__ret, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_getCopyDataInputState__ret, func() {
 		m := g.Match()
 		if m == nil {
 			return
 		}
 
-		r0 := core.GBA().Register(0)
+		r0 := core.Register(0)
 		if r0 != 2 {
 			log.Printf("expected getCopyDataInputState to be 2 but got %d", r0)
 		}
@@ -431,16 +500,16 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 		if m.Aborted() {
 			r0 = 4
 		}
-		core.GBA().SetRegister(0, r0)
+		core.SetRegister(0, r0)
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_commMenu_handleLinkCableInput__entry, func() {
-		log.Printf("unhandled call to commMenu_handleLinkCableInput at 0x%08x: uh oh!", core.GBA().Register(15)-4)
+	core.AddTrap(g.bn6.Offsets.ROM.A_commMenu_handleLinkCableInput__entry, func() {
+		log.Printf("unhandled call to commMenu_handleLinkCableInput at 0x%08x: uh oh!", core.Register(15)-4)
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_commMenu_waitForFriend__call__commMenu_handleLinkCableInput, func() {
-		core.GBA().SetRegister(15, core.GBA().Register(15)+0x4)
-		core.GBA().ThumbWritePC()
+	core.AddTrap(g.bn6.Offsets.ROM.A_commMenu_waitForFriend__call__commMenu_handleLinkCableInput, func() {
+		core.SetRegister(15, core.Register(15)+0x4)
+		core.ThumbWritePC()
 
 		ctx := context.Background()
 
@@ -457,7 +526,7 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 				log.Printf("matchmaking dialog did not return a code: %s", err)
 				g.bn6.DropMatchmakingFromCommMenu(core, 0)
 			} else {
-				match := match.New(g.conf, code, g.bn6.MatchType(g.mainCore), g.mainCore.GameTitle(), g.mainCore.CRC32())
+				match := match.New(g.conf, g.tangoVersion, code, g.bn6.MatchType(core), core.GameTitle(), core.CRC32())
 				g.match = match
 				go func() {
 					if err := match.Run(ctx); err != nil {
@@ -485,41 +554,40 @@ func (g *Game) InstallTraps(core *mgba.Core) error {
 				return
 			}
 
+			g.startSaveSandbox()
 			g.bn6.StartBattleFromCommMenu(core)
 			log.Printf("match started")
 		}
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_commMenu_initBattle__entry, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_commMenu_initBattle__entry, func() {
 		m := g.Match()
 		if m == nil {
 			return
 		}
 		battleSettingsAndBackground := g.bn6.RandomBattleSettingsAndBackground(m.RandSource(), uint8(m.Type()&0xff))
 		log.Printf("selected battle settings and background: %04x", battleSettingsAndBackground)
-		g.bn6.SetLinkBattleSettingsAndBackground(g.mainCore, battleSettingsAndBackground)
+		g.bn6.SetLinkBattleSettingsAndBackground(core, battleSettingsAndBackground)
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_commMenu_waitForFriend__ret__cancel, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_commMenu_waitForFriend__ret__cancel, func() {
 		log.Printf("match canceled by user")
 		g.endMatch()
 
-		core.GBA().SetRegister(15, core.GBA().Register(15)+0x4)
-		core.GBA().ThumbWritePC()
+		core.SetRegister(15, core.Register(15)+0x4)
+		core.ThumbWritePC()
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_commMenu_endBattle__entry, func() {
+	core.AddTrap(g.bn6.Offsets.ROM.A_commMenu_endBattle__entry, func() {
 		log.Printf("match ended")
 		g.endMatch()
 	})
 
-	tp.Add(g.bn6.Offsets.ROM.A_commMenu_inBattle__call__commMenu_handleLinkCableInput, func() {
-		core.GBA().SetRegister(15, core.GBA().Register(15)+0x4)
-		core.GBA().ThumbWritePC()
+	core.AddTrap(g.bn6.Offsets.ROM.A_commMenu_inBattle__call__commMenu_handleLinkCableInput, func() {
+		core.SetRegister(15, core.Register(15)+0x4)
+		core.ThumbWritePC()
 	})
 
-	tp.Attach(core.GBA())
-
 	return nil
 }
 
@@ -547,9 +615,52 @@ func (g *Game) Update() error {
 		g.debugSpew = !g.debugSpew
 	}
 
+	if g.conf.Keymapping.InputDisplay != -1 && inpututil.IsKeyJustPressed(ebiten.Key(g.conf.Keymapping.InputDisplay)) {
+		g.showInputDisplay = !g.showInputDisplay
+	}
+
+	// Turbo and slow motion are only for playing alone: during a match, the FPS target belongs to netplay. The speed is set again whenever a match starts or ends, so neither leaks into the other.
+	speed := float32(1)
+	inMatch := match != nil
+	if !inMatch {
+		if g.conf.Keymapping.Turbo != -1 && ebiten.IsKeyPressed(ebiten.Key(g.conf.Keymapping.Turbo)) {
+			speed = g.conf.Speed.Turbo
+		} else if g.conf.Keymapping.SlowMotion != -1 && ebiten.IsKeyPressed(ebiten.Key(g.conf.Keymapping.SlowMotion)) {
+			speed = g.conf.Speed.SlowMotion
+		}
+	}
+	if speed != g.speed || inMatch != g.inMatch {
+		g.speed = speed
+		g.inMatch = inMatch
+		g.setSpeed(speed)
+	}
+
+	g.updateStates()
+	g.updateRewindKey()
+
+	if atomic.LoadInt32(&g.saveCommitPending) != 0 {
+		g.askSaveCommit()
+	}
+
 	return nil
 }
 
+// setSpeed runs the main core at the given multiple of normal speed, or as fast as it can if speed is 0.
+func (g *Game) setSpeed(speed float32) {
+	// The mgba thread puts the sync back the way the options say after it is interrupted, so both need to agree.
+	opts := g.mainCore.Options()
+	opts.AudioSync = speed != 0
+	g.mainCore.SetOptions(opts)
+
+	sync := g.mainCore.GBA().Sync()
+	sync.SetAudioWait(opts.AudioSync)
+	if speed == 0 {
+		// Nothing is waiting on the audio, so this only sets how it is resampled.
+		speed = 1
+	}
+	sync.SetFPSTarget(float32(expectedFPS) * speed)
+}
+
 func (g *Game) scaleFactor(bounds image.Rectangle) int {
 	w, h := g.mainCore.DesiredVideoDimensions()
 	k := bounds.Dx() / w
@@ -575,6 +686,14 @@ func (g *Game) Draw(screen *ebiten.Image) {
 	g.fbuf.ReplacePixels(g.vbPix)
 	screen.DrawImage(g.fbuf, opts)
 
+	if g.showInputDisplay {
+		if match := g.Match(); match != nil && match.Battle() != nil {
+			g.inputDisplay.Draw(screen)
+		}
+	}
+
+	g.drawStateSlot(screen)
+
 	if g.debugSpew {
 		g.spewDebug(screen)
 	}
@@ -587,6 +706,8 @@ func (g *Game) Match() *match.Match {
 }
 
 func (g *Game) endMatch() error {
+	defer g.endSaveSandbox()
+
 	g.matchMu.Lock()
 	defer g.matchMu.Unlock()
 	if err := g.match.Close(); err != nil {
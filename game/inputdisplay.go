@@ -0,0 +1,213 @@
+package game
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"sync"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/murkland/tango/input"
+	"github.com/murkland/tango/mgba"
+)
+
+const inputHistoryLength = 16
+
+type inputHistoryEntry struct {
+	joyflags uint16
+	ticks    int
+}
+
+type inputDisplayPlayer struct {
+	current   uint16
+	predicted bool
+
+	confirmed     uint16
+	confirmedTick int
+
+	// history is the most recent confirmed inputs, run-length encoded, oldest first.
+	history []inputHistoryEntry
+}
+
+func (p *inputDisplayPlayer) addConfirmed(tick int, joyflags uint16) {
+	p.confirmed = joyflags
+	p.confirmedTick = tick
+
+	if n := len(p.history); n > 0 && p.history[n-1].joyflags == joyflags {
+		p.history[n-1].ticks++
+		return
+	}
+
+	p.history = append(p.history, inputHistoryEntry{joyflags, 1})
+	if len(p.history) > inputHistoryLength {
+		p.history = p.history[len(p.history)-inputHistoryLength:]
+	}
+}
+
+// InputDisplay shows both players' buttons and input history on top of the game.
+//
+// It is safe to update from the emulator thread while drawing from the ebiten thread.
+type InputDisplay struct {
+	mu      sync.Mutex
+	players [2]inputDisplayPlayer
+}
+
+func NewInputDisplay() *InputDisplay {
+	return &InputDisplay{}
+}
+
+func (d *InputDisplay) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.players = [2]inputDisplayPlayer{}
+}
+
+// AddConfirmed adds a confirmed input pair to the history, and makes it the current input for both players.
+func (d *InputDisplay) AddConfirmed(ip [2]input.Input) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.players {
+		p := &d.players[i]
+		p.addConfirmed(ip[i].LocalTick, ip[i].Joyflags&0x3ff)
+		p.current = p.confirmed
+		p.predicted = false
+	}
+}
+
+// SetCurrent sets the input a player is currently shown as holding, which may be a prediction that hasn't been confirmed yet.
+func (d *InputDisplay) SetCurrent(playerIndex int, joyflags uint16, predicted bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.players[playerIndex].current = joyflags & 0x3ff
+	d.players[playerIndex].predicted = predicted
+}
+
+// LoadReplay rebuilds the display as if the first n input pairs had been confirmed.
+func (d *InputDisplay) LoadReplay(inputPairs [][2]input.Input, n int) {
+	d.Reset()
+
+	if n > len(inputPairs) {
+		n = len(inputPairs)
+	}
+
+	// Only so much history fits on screen, so only replay enough of it to fill it up. Runs may be longer than this, but that's fine.
+	start := n - inputHistoryLength*60
+	if start < 0 {
+		start = 0
+	}
+	for _, ip := range inputPairs[start:n] {
+		d.AddConfirmed(ip)
+	}
+}
+
+// numpadDirection returns the direction in numpad notation, e.g. 5 is neutral and 3 is down-right.
+func numpadDirection(joyflags uint16) int {
+	x := 1
+	if joyflags&uint16(mgba.KeysLeft) != 0 {
+		x--
+	}
+	if joyflags&uint16(mgba.KeysRight) != 0 {
+		x++
+	}
+
+	y := 1
+	if joyflags&uint16(mgba.KeysDown) != 0 {
+		y--
+	}
+	if joyflags&uint16(mgba.KeysUp) != 0 {
+		y++
+	}
+
+	return y*3 + x + 1
+}
+
+var inputDisplayButtons = []struct {
+	key   mgba.Keys
+	label string
+}{
+	{mgba.KeysL, "L"},
+	{mgba.KeysR, "R"},
+	{mgba.KeysSelect, "Se"},
+	{mgba.KeysStart, "St"},
+	{mgba.KeysB, "B"},
+	{mgba.KeysA, "A"},
+}
+
+func formatJoyflags(joyflags uint16) string {
+	parts := []string{fmt.Sprintf("%d", numpadDirection(joyflags))}
+	for _, button := range inputDisplayButtons {
+		if joyflags&uint16(button.key) != 0 {
+			parts = append(parts, button.label)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+var (
+	inputDisplayBackgroundColor = color.RGBA{0x00, 0x00, 0x00, 0xa0}
+	inputDisplayOffColor        = color.RGBA{0x40, 0x40, 0x40, 0xff}
+	inputDisplayOnColor         = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	inputDisplayPredictedColor  = color.RGBA{0xff, 0xa0, 0x00, 0xff}
+)
+
+const (
+	inputDisplayCell       = 6
+	inputDisplayLineHeight = 16
+	inputDisplayWidth      = 160
+)
+
+func drawButton(screen *ebiten.Image, x float64, y float64, w float64, on bool, onColor color.Color) {
+	c := color.Color(inputDisplayOffColor)
+	if on {
+		c = onColor
+	}
+	ebitenutil.DrawRect(screen, x, y, w, inputDisplayCell, c)
+}
+
+func (p *inputDisplayPlayer) draw(screen *ebiten.Image, x int, title string) {
+	height := inputDisplayCell*4 + inputDisplayLineHeight*(len(p.history)+2)
+	ebitenutil.DrawRect(screen, float64(x), 0, inputDisplayWidth, float64(height), inputDisplayBackgroundColor)
+
+	onColor := color.Color(inputDisplayOnColor)
+	if p.predicted {
+		onColor = inputDisplayPredictedColor
+	}
+
+	// D-pad, as a 3x3 grid with the directions lit up.
+	dx := float64(x + inputDisplayCell)
+	dy := float64(inputDisplayCell)
+	drawButton(screen, dx+inputDisplayCell, dy, inputDisplayCell, p.current&uint16(mgba.KeysUp) != 0, onColor)
+	drawButton(screen, dx, dy+inputDisplayCell, inputDisplayCell, p.current&uint16(mgba.KeysLeft) != 0, onColor)
+	drawButton(screen, dx+inputDisplayCell*2, dy+inputDisplayCell, inputDisplayCell, p.current&uint16(mgba.KeysRight) != 0, onColor)
+	drawButton(screen, dx+inputDisplayCell, dy+inputDisplayCell*2, inputDisplayCell, p.current&uint16(mgba.KeysDown) != 0, onColor)
+
+	bx := dx + inputDisplayCell*4
+	for _, button := range inputDisplayButtons {
+		drawButton(screen, bx, dy+inputDisplayCell, inputDisplayCell*2, p.current&uint16(button.key) != 0, onColor)
+		bx += inputDisplayCell * 3
+	}
+
+	lines := []string{title}
+	if p.predicted {
+		// Show what we actually know alongside the prediction.
+		lines = append(lines, fmt.Sprintf("pred, conf %s @%d", formatJoyflags(p.confirmed), p.confirmedTick))
+	} else {
+		lines = append(lines, "")
+	}
+	for i := len(p.history) - 1; i >= 0; i-- {
+		entry := p.history[i]
+		lines = append(lines, fmt.Sprintf("%3d %s", entry.ticks, formatJoyflags(entry.joyflags)))
+	}
+
+	ebitenutil.DebugPrintAt(screen, strings.Join(lines, "\n"), x+2, inputDisplayCell*4)
+}
+
+// Draw draws both players' inputs: p1 in the top left corner and p2 in the top right corner.
+func (d *InputDisplay) Draw(screen *ebiten.Image) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.players[0].draw(screen, 0, "P1")
+	d.players[1].draw(screen, screen.Bounds().Dx()-inputDisplayWidth, "P2")
+}
@@ -1,66 +1,531 @@
 package game
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"sort"
 
-	"github.com/murkland/ringbuf"
 	"github.com/murkland/tango/bn6"
-	"github.com/murkland/tango/input"
 	"github.com/murkland/tango/mgba"
 	"github.com/murkland/tango/replay"
 )
 
+// DefaultSnapshotInterval is how many ticks apart the replayer takes in-memory snapshots while playing, for seeking backwards.
+const DefaultSnapshotInterval = 60
+
+// RewindWindow is how many ticks of states StepBack re-simulates and keeps at a time, so stepping back tick by tick only re-simulates from a snapshot once per window.
+const RewindWindow = 60
+
+// MaxSnapshots is the most snapshots the replayer keeps from playing. Once there would be more, every other one is dropped and they are taken half as often from then on.
+const MaxSnapshots = 256
+
 type Replayer struct {
-	core *mgba.Core
+	core mgba.Emulator
 	bn6  *bn6.BN6
 
-	replay *replay.Replay
+	// rs is the replay being played. Ticks are read from it as they are needed, and keyframes are found through its index.
+	rs     io.ReadSeeker
+	reader *replay.Reader
+	index  []replay.IndexEntry
+	err    error
+
+	metadata         replay.Metadata
+	state            *mgba.State
+	init             [2][]byte
+	localPlayerIndex int
+	firstTick        int
+	numTicks         int
+	turnTicks        []int
+
+	// next is the next tick to be applied, or nil if there are no more.
+	next *replay.Tick
 
-	currentInputPairs *ringbuf.RingBuf[[2]input.Input]
+	// snapshots are the states taken while playing, sorted by tick.
+	snapshots        []replay.Keyframe
+	snapshotInterval int
+	// snapshotStride is how many ticks apart snapshots are actually taken, which grows as they are thinned out.
+	snapshotStride int
+
+	// window holds a state for each of the ticks just before where StepBack last re-simulated to, sorted by tick.
+	window          []replay.Keyframe
+	recordingWindow bool
+
+	endedCallback func()
+	inputCallback func(tick replay.Tick)
+
+	seeking   bool
+	seekEnded bool
 }
 
 func (rp *Replayer) Reset() {
-	rp.currentInputPairs = ringbuf.New[[2]input.Input](len(rp.replay.InputPairs))
-	rp.currentInputPairs.Push(rp.replay.InputPairs)
-	rp.core.LoadState(rp.replay.State)
-	rp.bn6.SetPlayerMarshaledBattleState(rp.core, 0, rp.replay.Init[0])
-	rp.bn6.SetPlayerMarshaledBattleState(rp.core, 1, rp.replay.Init[1])
+	rp.core.LoadState(rp.state)
+	rp.bn6.SetPlayerMarshaledBattleState(rp.core, 0, rp.init[0])
+	rp.bn6.SetPlayerMarshaledBattleState(rp.core, 1, rp.init[1])
+	rp.fail(rp.readFrom(rp.firstTick))
+}
+
+// open reads through the replay once to find where it starts and ends and where its turns are, then starts reading it again from the beginning.
+func (rp *Replayer) open(rs io.ReadSeeker) error {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	rr, err := replay.NewReader(rs)
+	if err != nil {
+		return err
+	}
+	defer rr.Close()
+
+	firstTick := 0
+	numTicks := 0
+	var turnTicks []int
+	for {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		ip := tick.InputPair
+		if numTicks == 0 {
+			firstTick = ip[0].LocalTick
+		}
+		numTicks++
+		if ip[0].Turn != nil || ip[1].Turn != nil {
+			turnTicks = append(turnTicks, ip[0].LocalTick)
+		}
+	}
+
+	index, err := replay.ReadIndex(rs)
+	if err != nil {
+		return err
+	}
+
+	if rp.reader != nil {
+		rp.reader.Close()
+	}
+	*rp = Replayer{
+		core: rp.core,
+		bn6:  rp.bn6,
+
+		rs:    rs,
+		index: index,
+
+		metadata:         rr.Header(),
+		state:            rr.State(),
+		init:             rr.Inits(),
+		localPlayerIndex: rr.LocalPlayerIndex(),
+		firstTick:        firstTick,
+		numTicks:         numTicks,
+		turnTicks:        turnTicks,
+
+		snapshotInterval: rp.snapshotInterval,
+		snapshotStride:   rp.snapshotInterval,
+
+		endedCallback: rp.endedCallback,
+		inputCallback: rp.inputCallback,
+	}
+	return rp.openReader()
+}
+
+// openReader starts reading the replay from the beginning.
+func (rp *Replayer) openReader() error {
+	if rp.reader != nil {
+		rp.reader.Close()
+		rp.reader = nil
+	}
+	rp.next = nil
+
+	if _, err := rp.rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	rr, err := replay.NewReader(rp.rs)
+	if err != nil {
+		return err
+	}
+	rp.reader = rr
+	return rp.advance()
+}
+
+// advance reads the next tick, leaving next nil once there are no more.
+func (rp *Replayer) advance() error {
+	tick, err := rp.reader.Next()
+	if err != nil {
+		rp.next = nil
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	rp.next = &tick
+	return nil
+}
+
+// readFrom moves the reader so the given tick is the next one, reading on from where it is if that's closer than the last keyframe before the tick.
+func (rp *Replayer) readFrom(tick int) error {
+	i := sort.Search(len(rp.index), func(i int) bool {
+		return rp.index[i].Tick > tick
+	})
+
+	ahead := rp.reader != nil && rp.next != nil && rp.next.InputPair[0].LocalTick <= tick && (i == 0 || rp.index[i-1].Tick <= rp.next.InputPair[0].LocalTick)
+	if !ahead {
+		if i > 0 && rp.reader != nil {
+			if err := rp.reader.SeekKeyframe(rp.index[i-1]); err != nil {
+				return err
+			}
+			if err := rp.advance(); err != nil {
+				return err
+			}
+		} else if err := rp.openReader(); err != nil {
+			return err
+		}
+	}
+
+	for rp.next != nil && rp.next.InputPair[0].LocalTick < tick {
+		if err := rp.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail stops playback if reading the replay failed. Only the first error is kept.
+func (rp *Replayer) fail(err error) {
+	if err == nil {
+		return
+	}
+	rp.next = nil
+	if rp.err == nil {
+		log.Printf("failed to read replay: %s", err)
+		rp.err = err
+	}
+}
+
+// Err returns the first error that happened while reading the replay, if any. Playback stops at the first error, as if the replay had ended there.
+func (rp *Replayer) Err() error {
+	return rp.err
+}
+
+// Load switches to another replay for the same game and resets to its start. Snapshots from the previous replay are dropped.
+//
+// The core must not be running on another thread when this is called.
+func (rp *Replayer) Load(rs io.ReadSeeker) error {
+	if err := rp.open(rs); err != nil {
+		return err
+	}
+	rp.Reset()
+	return nil
 }
 
+// Close stops reading the replay. It doesn't close the replay itself.
+func (rp *Replayer) Close() {
+	if rp.reader != nil {
+		rp.reader.Close()
+		rp.reader = nil
+	}
+	rp.next = nil
+}
+
+// Core returns the core the replayer runs on, or nil if it runs on some other emulator.
 func (rp *Replayer) Core() *mgba.Core {
-	return rp.core
+	core, _ := rp.core.(*mgba.Core)
+	return core
+}
+
+func (rp *Replayer) BN6() *bn6.BN6 {
+	return rp.bn6
+}
+
+// Metadata returns the replay's metadata, including its result.
+func (rp *Replayer) Metadata() replay.Metadata {
+	return rp.metadata
+}
+
+// SetEndedCallback sets the function to call when the battle ends or the replay runs out of inputs. By default, the replayer is reset.
+func (rp *Replayer) SetEndedCallback(f func()) {
+	rp.endedCallback = f
 }
 
-func NewReplayer(romPath string, r *replay.Replay) (*Replayer, error) {
+// SetInputCallback sets the function to call right after each tick of the replay is applied.
+func (rp *Replayer) SetInputCallback(f func(tick replay.Tick)) {
+	rp.inputCallback = f
+}
+
+// SetSnapshotInterval sets how many ticks apart snapshots are taken while playing, or 0 to not take any.
+func (rp *Replayer) SetSnapshotInterval(interval int) {
+	rp.snapshotInterval = interval
+	rp.snapshotStride = interval
+}
+
+func (rp *Replayer) ended() {
+	if rp.seeking {
+		rp.seekEnded = true
+		return
+	}
+	rp.endedCallback()
+}
+
+// FirstTick returns the tick of the first input in the replay.
+func (rp *Replayer) FirstTick() int {
+	return rp.firstTick
+}
+
+// LastTick returns the tick after the last input in the replay.
+func (rp *Replayer) LastTick() int {
+	return rp.firstTick + rp.numTicks
+}
+
+// Tick returns the tick of the next input to be applied.
+func (rp *Replayer) Tick() int {
+	return int(rp.bn6.InBattleTime(rp.core))
+}
+
+// TurnTicks returns the ticks of all the inputs that committed a turn.
+func (rp *Replayer) TurnTicks() []int {
+	return rp.turnTicks
+}
+
+func (rp *Replayer) takeSnapshot(tick int) {
+	// The replay already has this state on disk.
+	if rp.isKeyframe(tick) {
+		return
+	}
+
+	i := sort.Search(len(rp.snapshots), func(i int) bool {
+		return rp.snapshots[i].Tick >= tick
+	})
+	if i < len(rp.snapshots) && rp.snapshots[i].Tick == tick {
+		return
+	}
+
+	rp.snapshots = append(rp.snapshots, replay.Keyframe{})
+	copy(rp.snapshots[i+1:], rp.snapshots[i:])
+	rp.snapshots[i] = replay.Keyframe{Tick: tick, State: rp.core.SaveState()}
+
+	if len(rp.snapshots) > MaxSnapshots {
+		rp.thinSnapshots()
+	}
+}
+
+func (rp *Replayer) isKeyframe(tick int) bool {
+	i := sort.Search(len(rp.index), func(i int) bool {
+		return rp.index[i].Tick >= tick
+	})
+	return i < len(rp.index) && rp.index[i].Tick == tick
+}
+
+// thinSnapshots drops every other snapshot and takes them half as often from then on, so they stay evenly spread out.
+func (rp *Replayer) thinSnapshots() {
+	rp.snapshotStride *= 2
+
+	kept := rp.snapshots[:0]
+	for _, snapshot := range rp.snapshots {
+		if snapshot.Tick%rp.snapshotStride != 0 {
+			continue
+		}
+		kept = append(kept, snapshot)
+	}
+
+	// Let go of the dropped states.
+	for i := len(kept); i < len(rp.snapshots); i++ {
+		rp.snapshots[i] = replay.Keyframe{}
+	}
+	rp.snapshots = kept
+}
+
+func (rp *Replayer) discardAudio() {
+	core := rp.Core()
+	if core == nil {
+		return
+	}
+
+	sync := core.GBA().Sync()
+	if sync != nil {
+		sync.LockAudio()
+	}
+	core.AudioChannel(0).Clear()
+	core.AudioChannel(1).Clear()
+	if sync != nil {
+		sync.ConsumeAudio()
+	}
+}
+
+// Step runs a single frame. Audio produced by the frame is discarded.
+//
+// The core must not be running on another thread when this is called.
+func (rp *Replayer) Step() {
+	rp.core.RunFrame()
+	rp.discardAudio()
+}
+
+// resume continues from a state taken in the readJoyflags trap, for the given tick.
+func (rp *Replayer) resume(tick int, state *mgba.State) {
+	rp.core.LoadState(state)
+	rp.fail(rp.readFrom(tick))
+
+	// Snapshots and keyframes are taken in the readJoyflags trap, so resume from there.
+	rp.core.SetRegister(15, rp.bn6.Offsets.ROM.A_main__readJoyflags)
+	rp.core.ThumbWritePC()
+}
+
+// loadKeyframe continues from one of the replay's own keyframes.
+func (rp *Replayer) loadKeyframe(entry replay.IndexEntry) error {
+	if err := rp.reader.SeekKeyframe(entry); err != nil {
+		return err
+	}
+	if err := rp.advance(); err != nil {
+		return err
+	}
+	if rp.next == nil || rp.next.Keyframe == nil {
+		return fmt.Errorf("no keyframe at tick %d", entry.Tick)
+	}
+
+	state := rp.next.Keyframe.State
+	rp.next.Keyframe = nil
+	rp.resume(entry.Tick, state)
+	return nil
+}
+
+// Seek runs the replay until the given tick is the next one to be applied, starting from the closest snapshot or keyframe before it.
+//
+// The core must not be running on another thread when this is called.
+func (rp *Replayer) Seek(tick int) {
+	if tick > rp.LastTick() {
+		tick = rp.LastTick()
+	}
+
+	i := sort.Search(len(rp.snapshots), func(i int) bool {
+		return rp.snapshots[i].Tick >= tick
+	})
+	j := sort.Search(len(rp.index), func(j int) bool {
+		return rp.index[j].Tick >= tick
+	})
+
+	switch {
+	case j > 0 && rp.reader != nil && (i == 0 || rp.index[j-1].Tick > rp.snapshots[i-1].Tick):
+		if err := rp.loadKeyframe(rp.index[j-1]); err != nil {
+			rp.fail(err)
+			return
+		}
+	case i > 0:
+		rp.resume(rp.snapshots[i-1].Tick, rp.snapshots[i-1].State)
+	default:
+		rp.Reset()
+	}
+
+	rp.seeking = true
+	rp.seekEnded = false
+	defer func() {
+		rp.seeking = false
+	}()
+
+	// Always run at least one frame, so there's something to show.
+	rp.Step()
+	for rp.Tick() < tick && !rp.seekEnded {
+		rp.Step()
+	}
+}
+
+// StepBack goes back one tick. The states of the ticks leading up to it are kept, so calling it again doesn't need to re-simulate from a snapshot until they run out.
+//
+// The core must not be running on another thread when this is called.
+func (rp *Replayer) StepBack() {
+	tick := rp.Tick() - 1
+	if tick < rp.FirstTick() {
+		tick = rp.FirstTick()
+	}
+
+	// The state for the tick before is loaded and run forward by one tick, so there's something to show.
+	i := sort.Search(len(rp.window), func(i int) bool {
+		return rp.window[i].Tick >= tick-1
+	})
+	if i == len(rp.window) || rp.window[i].Tick != tick-1 {
+		rp.window = nil
+		rp.recordingWindow = true
+		defer func() {
+			rp.recordingWindow = false
+		}()
+		rp.Seek(tick)
+		return
+	}
+
+	state := rp.window[i]
+	for j := i; j < len(rp.window); j++ {
+		rp.window[j] = replay.Keyframe{}
+	}
+	rp.window = rp.window[:i]
+
+	rp.resume(state.Tick, state.State)
+	rp.Step()
+}
+
+// NewReplayer makes a replayer for a replay file, which is read from as the replay plays and must stay open until the replayer is closed.
+func NewReplayer(romPath string, rs io.ReadSeeker) (*Replayer, error) {
 	core, err := newCore(romPath)
 	if err != nil {
 		return nil, err
 	}
+	return NewReplayerWithEmulator(core, rs)
+}
 
+// NewReplayerWithEmulator makes a replayer that runs on the given emulator, which must not be used for anything else.
+func NewReplayerWithEmulator(core mgba.Emulator, rs io.ReadSeeker) (*Replayer, error) {
 	bn6 := bn6.Load(core.GameTitle())
 	if bn6 == nil {
 		return nil, fmt.Errorf("unsupported game: %s", core.GameTitle())
 	}
 
-	rp := &Replayer{core, bn6, r, nil}
+	rp := &Replayer{
+		core:             core,
+		bn6:              bn6,
+		snapshotInterval: DefaultSnapshotInterval,
+	}
+	if err := rp.open(rs); err != nil {
+		return nil, err
+	}
+	rp.endedCallback = rp.Reset
+
+	core.AddTrap(bn6.Offsets.ROM.A_main__readJoyflags, func() {
+		if rp.next == nil {
+			rp.ended()
+			return
+		}
 
-	tp := mgba.NewTrapper(core)
+		ip := rp.next.InputPair
 
-	tp.Add(bn6.Offsets.ROM.A_main__readJoyflags, func() {
-		var inputPairBuf [1][2]input.Input
-		rp.currentInputPairs.Peek(inputPairBuf[:], 0)
-		ip := inputPairBuf[0]
-		core.GBA().SetRegister(4, uint32(ip[rp.replay.LocalPlayerIndex].Joyflags))
+		inBattleTime := int(rp.bn6.InBattleTime(rp.core))
+		if rp.snapshotStride > 0 && inBattleTime%rp.snapshotStride == 0 && ip[0].LocalTick == inBattleTime {
+			rp.takeSnapshot(inBattleTime)
+		}
+
+		if rp.recordingWindow && ip[0].LocalTick == inBattleTime {
+			rp.window = append(rp.window, replay.Keyframe{Tick: inBattleTime, State: rp.core.SaveState()})
+			if len(rp.window) > RewindWindow {
+				rp.window[0] = replay.Keyframe{}
+				rp.window = rp.window[1:]
+			}
+		}
+
+		core.SetRegister(4, uint32(ip[rp.localPlayerIndex].Joyflags))
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_battle_update__call__battle_copyInputData, func() {
-		rp.core.GBA().SetRegister(0, 0)
-		rp.core.GBA().SetRegister(15, rp.core.GBA().Register(15)+4)
-		rp.core.GBA().ThumbWritePC()
+	core.AddTrap(bn6.Offsets.ROM.A_battle_update__call__battle_copyInputData, func() {
+		if rp.next == nil {
+			return
+		}
+
+		rp.core.SetRegister(0, 0)
+		rp.core.SetRegister(15, rp.core.Register(15)+4)
+		rp.core.ThumbWritePC()
 
-		var inputPairBuf [1][2]input.Input
-		rp.currentInputPairs.Pop(inputPairBuf[:], 0)
-		ip := inputPairBuf[0]
+		tick := *rp.next
+		rp.fail(rp.advance())
+		ip := tick.InputPair
 
 		bn6.SetPlayerInputState(rp.core, 0, ip[0].Joyflags, ip[0].CustomScreenState)
 		if ip[0].Turn != nil {
@@ -71,30 +536,32 @@ func NewReplayer(romPath string, r *replay.Replay) (*Replayer, error) {
 		if ip[1].Turn != nil {
 			bn6.SetPlayerMarshaledBattleState(rp.core, 1, ip[1].Turn)
 		}
-	})
 
-	tp.Add(bn6.Offsets.ROM.A_battle_isP2__tst, func() {
-		rp.core.GBA().SetRegister(0, uint32(rp.replay.LocalPlayerIndex))
+		if rp.inputCallback != nil {
+			rp.inputCallback(tick)
+		}
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_link_isP2__ret, func() {
-		rp.core.GBA().SetRegister(0, uint32(rp.replay.LocalPlayerIndex))
+	core.AddTrap(bn6.Offsets.ROM.A_battle_isP2__tst, func() {
+		rp.core.SetRegister(0, uint32(rp.localPlayerIndex))
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_commMenu_inBattle__call__commMenu_handleLinkCableInput, func() {
-		rp.core.GBA().SetRegister(15, rp.core.GBA().Register(15)+4)
-		rp.core.GBA().ThumbWritePC()
+	core.AddTrap(bn6.Offsets.ROM.A_link_isP2__ret, func() {
+		rp.core.SetRegister(0, uint32(rp.localPlayerIndex))
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_getCopyDataInputState__ret, func() {
-		core.GBA().SetRegister(0, 2)
+	core.AddTrap(bn6.Offsets.ROM.A_commMenu_inBattle__call__commMenu_handleLinkCableInput, func() {
+		rp.core.SetRegister(15, rp.core.Register(15)+4)
+		rp.core.ThumbWritePC()
 	})
 
-	tp.Add(bn6.Offsets.ROM.A_battle_ending__ret, func() {
-		rp.Reset()
+	core.AddTrap(bn6.Offsets.ROM.A_getCopyDataInputState__ret, func() {
+		core.SetRegister(0, 2)
 	})
 
-	tp.Attach(core.GBA())
+	core.AddTrap(bn6.Offsets.ROM.A_battle_ending__ret, func() {
+		rp.ended()
+	})
 
 	return rp, nil
 }
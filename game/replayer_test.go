@@ -0,0 +1,175 @@
+package game
+
+import (
+	"os"
+	"testing"
+
+	"github.com/murkland/tango/replay"
+)
+
+// newTestReplayer records a replay of the input pairs and opens a replayer on it.
+func newTestReplayer(t *testing.T, n int, keyframeInterval int) (*Replayer, []replay.Tick) {
+	inputPairs := fakeInputPairs(n)
+	path := recordReplay(t, inputPairs, keyframeInterval)
+	ticks := readTestReplay(t, path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	core, _ := newFakeGame()
+	rp, err := NewReplayerWithEmulator(core, f)
+	if err != nil {
+		t.Fatalf("NewReplayerWithEmulator: %s", err)
+	}
+	t.Cleanup(rp.Close)
+	return rp, ticks
+}
+
+func TestReplayerPlaysThrough(t *testing.T) {
+	rp, ticks := newTestReplayer(t, 250, 40)
+	rp.SetSnapshotInterval(0)
+
+	if rp.FirstTick() != 0 || rp.LastTick() != len(ticks) {
+		t.Fatalf("replay covers ticks %d to %d, want 0 to %d", rp.FirstTick(), rp.LastTick(), len(ticks))
+	}
+	if turnTicks := rp.TurnTicks(); len(turnTicks) != 2 || turnTicks[0] != 50 || turnTicks[1] != 150 {
+		t.Errorf("turn ticks = %v, want [50 150]", turnTicks)
+	}
+
+	applied := 0
+	rp.SetInputCallback(func(tick replay.Tick) {
+		if tick.InputPair[0].LocalTick != applied {
+			t.Fatalf("applied tick %d, want %d", tick.InputPair[0].LocalTick, applied)
+		}
+		// The input callback is called before the frame has used the inputs, so the RNG is still as it was at the start of the tick.
+		if rng := rp.BN6().RNG2State(rp.core); rng != tick.RNGState {
+			t.Fatalf("tick %d rng = %08x, want %08x", applied, rng, tick.RNGState)
+		}
+		applied++
+	})
+
+	ended := false
+	rp.SetEndedCallback(func() {
+		ended = true
+	})
+	rp.Reset()
+
+	for i := 0; !ended; i++ {
+		if i > len(ticks)+10 {
+			t.Fatalf("replay didn't end after %d frames", i)
+		}
+		rp.Step()
+	}
+
+	if err := rp.Err(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if applied != len(ticks) {
+		t.Errorf("applied %d ticks, want %d", applied, len(ticks))
+	}
+}
+
+func TestReplayerSeek(t *testing.T) {
+	for _, keyframeInterval := range []int{0, 25} {
+		rp, ticks := newTestReplayer(t, 200, keyframeInterval)
+		rp.SetEndedCallback(func() {})
+		rp.Reset()
+
+		// Go forwards and backwards, past and between keyframes and snapshots.
+		for _, tick := range []int{120, 30, 31, 75, 199, 0, 60, 59, 150, 1} {
+			rp.Seek(tick)
+			if err := rp.Err(); err != nil {
+				t.Fatalf("keyframe interval %d: Seek(%d): %s", keyframeInterval, tick, err)
+			}
+
+			want := tick
+			if want == 0 {
+				// Seek always runs at least one frame.
+				want = 1
+			}
+			if got := rp.Tick(); got != want {
+				t.Errorf("keyframe interval %d: Seek(%d) went to tick %d", keyframeInterval, tick, got)
+				continue
+			}
+			if rng := rp.BN6().RNG2State(rp.core); rng != ticks[want].RNGState {
+				t.Errorf("keyframe interval %d: Seek(%d) rng = %08x, want %08x", keyframeInterval, tick, rng, ticks[want].RNGState)
+			}
+		}
+	}
+}
+
+func TestReplayerSeekAndPlay(t *testing.T) {
+	rp, ticks := newTestReplayer(t, 200, 25)
+	rp.SetSnapshotInterval(0)
+	rp.SetEndedCallback(func() {})
+	rp.Reset()
+
+	rp.Seek(110)
+
+	// After seeking to a tick between keyframes, the rest of the replay plays on from there.
+	next := rp.Tick()
+	rp.SetInputCallback(func(tick replay.Tick) {
+		if tick.InputPair[0].LocalTick != next {
+			t.Fatalf("applied tick %d, want %d", tick.InputPair[0].LocalTick, next)
+		}
+		if rng := rp.BN6().RNG2State(rp.core); rng != ticks[next].RNGState {
+			t.Fatalf("tick %d rng = %08x, want %08x", next, rng, ticks[next].RNGState)
+		}
+		next++
+	})
+	for rp.Tick() < len(ticks) {
+		rp.Step()
+	}
+
+	if err := rp.Err(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if next != len(ticks) {
+		t.Errorf("applied up to tick %d, want %d", next, len(ticks))
+	}
+}
+
+func TestReplayerStepBack(t *testing.T) {
+	rp, ticks := newTestReplayer(t, 200, 0)
+	rp.SetEndedCallback(func() {})
+	rp.Reset()
+
+	rp.Seek(150)
+	for want := 149; want > 150-2*RewindWindow-5; want-- {
+		rp.StepBack()
+		if got := rp.Tick(); got != want {
+			t.Fatalf("StepBack went to tick %d, want %d", got, want)
+		}
+		if rng := rp.BN6().RNG2State(rp.core); rng != ticks[want].RNGState {
+			t.Fatalf("StepBack to tick %d rng = %08x, want %08x", want, rng, ticks[want].RNGState)
+		}
+	}
+
+	if err := rp.Err(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+}
+
+func TestReplayerSnapshotsSkipKeyframes(t *testing.T) {
+	rp, _ := newTestReplayer(t, 200, 20)
+	rp.SetSnapshotInterval(10)
+	rp.SetEndedCallback(func() {})
+	rp.Reset()
+
+	for rp.Tick() < 199 {
+		rp.Step()
+	}
+
+	// Every other snapshot tick is a keyframe, which doesn't need a snapshot.
+	for _, snapshot := range rp.snapshots {
+		if snapshot.Tick%20 == 0 {
+			t.Errorf("took a snapshot at tick %d, which has a keyframe", snapshot.Tick)
+		}
+	}
+	if len(rp.snapshots) != 10 {
+		t.Errorf("took %d snapshots, want 10", len(rp.snapshots))
+	}
+}
@@ -0,0 +1,130 @@
+package game
+
+import (
+	"sync/atomic"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/murkland/tango/mgba"
+)
+
+// rewindBuffer holds the most recent snapshots, dropping the oldest once it is full.
+type rewindBuffer struct {
+	states []*mgba.State
+	start  int
+	n      int
+}
+
+func newRewindBuffer(capacity int) *rewindBuffer {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &rewindBuffer{states: make([]*mgba.State, capacity)}
+}
+
+func (rb *rewindBuffer) push(state *mgba.State) {
+	if len(rb.states) == 0 {
+		return
+	}
+	rb.states[(rb.start+rb.n)%len(rb.states)] = state
+	if rb.n < len(rb.states) {
+		rb.n++
+	} else {
+		rb.start = (rb.start + 1) % len(rb.states)
+	}
+}
+
+// pop removes and returns the newest snapshot, or nil if there are none left.
+func (rb *rewindBuffer) pop() *mgba.State {
+	if rb.n == 0 {
+		return nil
+	}
+	rb.n--
+	i := (rb.start + rb.n) % len(rb.states)
+	state := rb.states[i]
+	rb.states[i] = nil
+	return state
+}
+
+func (rb *rewindBuffer) clear() {
+	for i := range rb.states {
+		rb.states[i] = nil
+	}
+	rb.start = 0
+	rb.n = 0
+}
+
+// updateRewind takes a snapshot every few frames, or steps back through the snapshots while rewinding.
+//
+// While rewinding, each snapshot is reloaded every frame for as many frames as there were between snapshots, so the game goes backwards at normal speed and stays on the snapshot instead of running on from it.
+//
+// This must be called from the mgba thread, between frames.
+func (g *Game) updateRewind() {
+	if g.conf.Rewind.Snapshots <= 0 {
+		return
+	}
+
+	// Netplay must never be rewound, and snapshots from before a match shouldn't be loaded into one either.
+	if g.Match() != nil {
+		g.clearRewind()
+		return
+	}
+
+	if atomic.LoadInt32(&g.rewinding) != 0 {
+		if g.rewindState == nil || g.rewindFrames >= g.conf.Rewind.Interval {
+			// Once the snapshots run out, stay on the oldest one.
+			if state := g.rewind.pop(); state != nil {
+				g.rewindState = state
+			}
+			g.rewindFrames = 0
+		}
+		g.rewindFrames++
+
+		if g.rewindState != nil {
+			g.mainCore.LoadState(g.rewindState)
+		}
+		return
+	}
+
+	if g.rewindState != nil {
+		// Rewinding just stopped, so carry on from the snapshot that was shown last.
+		g.rewindState = nil
+		g.rewindFrames = 0
+	}
+
+	g.rewindFrames++
+	if g.rewindFrames < g.conf.Rewind.Interval {
+		return
+	}
+	g.rewindFrames = 0
+
+	if state := g.mainCore.SaveState(); state != nil {
+		g.rewind.push(state)
+	}
+}
+
+// clearRewind drops every snapshot, so the game can't be rewound to before now.
+//
+// This must be called from the mgba thread, or while it is paused.
+func (g *Game) clearRewind() {
+	g.rewind.clear()
+	g.rewindState = nil
+	g.rewindFrames = 0
+}
+
+// updateRewindKey starts or stops rewinding as the rewind key is pressed and released, muting the audio while rewinding.
+func (g *Game) updateRewindKey() {
+	rewinding := g.conf.Rewind.Snapshots > 0 && g.conf.Keymapping.Rewind != -1 && g.Match() == nil && ebiten.IsKeyPressed(ebiten.Key(g.conf.Keymapping.Rewind))
+	wasRewinding := atomic.LoadInt32(&g.rewinding) != 0
+	if rewinding == wasRewinding {
+		return
+	}
+
+	if rewinding {
+		g.rewindVolume = g.gameAudioPlayer.Volume()
+		g.gameAudioPlayer.SetVolume(0)
+		atomic.StoreInt32(&g.rewinding, 1)
+	} else {
+		atomic.StoreInt32(&g.rewinding, 0)
+		g.gameAudioPlayer.SetVolume(g.rewindVolume)
+	}
+}
@@ -0,0 +1,204 @@
+package game
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ncruces/zenity"
+)
+
+const backupTimeFormat = "20060102150405"
+
+// backupSave copies the save into saves/backups, keeping only the newest n backups of it.
+func backupSave(savePath string, n int) error {
+	f, err := os.Open(savePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	backupsDir := filepath.Join(filepath.Dir(savePath), "backups")
+	if err := os.MkdirAll(backupsDir, 0o700); err != nil {
+		return err
+	}
+
+	saveFilename := filepath.Base(savePath)
+	ext := filepath.Ext(saveFilename)
+	name := saveFilename[:len(saveFilename)-len(ext)]
+
+	backupPath := filepath.Join(backupsDir, fmt.Sprintf("%s_%s%s", name, time.Now().Format(backupTimeFormat), ext))
+	if err := copyToFile(backupPath, f); err != nil {
+		return err
+	}
+	log.Printf("backed up save file: %s", backupPath)
+
+	dirents, err := os.ReadDir(backupsDir)
+	if err != nil {
+		return err
+	}
+
+	// Only match this save's own backups, not those of another save whose name starts the same way.
+	backupPattern := regexp.MustCompile("^" + regexp.QuoteMeta(name) + `_\d{14}` + regexp.QuoteMeta(ext) + "$")
+
+	var backups []string
+	for _, dirent := range dirents {
+		if dirent.IsDir() || !backupPattern.MatchString(dirent.Name()) {
+			continue
+		}
+		backups = append(backups, dirent.Name())
+	}
+
+	// The timestamp sorts in the same order as the time, so the oldest backups come first.
+	sort.Strings(backups)
+	for len(backups) > n {
+		if err := os.Remove(filepath.Join(backupsDir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// copyToFile writes r to a temporary file first, so a crash partway through never leaves a half-written file at path.
+func copyToFile(path string, r io.Reader) error {
+	tmpPath := path + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// startSaveSandbox makes the game write to an in-memory copy of the save until endSaveSandbox.
+//
+// This must be called from the mgba thread.
+func (g *Game) startSaveSandbox() {
+	if !g.conf.Saves.SandboxNetplay || g.sandboxVF != nil {
+		return
+	}
+
+	vf, original, err := g.mainCore.GBA().MaskSave()
+	if err != nil {
+		log.Printf("failed to sandbox save, netplay will use the real save: %s", err)
+		return
+	}
+	g.sandboxVF = vf
+	g.sandboxOriginal = original
+	log.Printf("save sandboxed for netplay")
+}
+
+// endSaveSandbox puts the real save back if the game didn't write anything to the sandbox. Otherwise, the sandbox stays in place until askSaveCommit has asked the player whether to keep it.
+//
+// This must be called from the mgba thread.
+func (g *Game) endSaveSandbox() {
+	if g.sandboxVF == nil {
+		return
+	}
+
+	sandboxed, err := g.sandboxVF.Bytes()
+	if err != nil {
+		log.Printf("failed to read sandboxed save, discarding it: %s", err)
+	}
+
+	if sandboxed == nil || bytes.Equal(sandboxed, g.sandboxOriginal) {
+		g.unmaskSave(false)
+		return
+	}
+
+	atomic.StoreInt32(&g.saveCommitPending, 1)
+}
+
+// askSaveCommit asks the player whether to keep what netplay wrote to the sandbox, then commits or discards it once they have answered.
+//
+// The question is asked on its own goroutine, so the game keeps running while it is open. This must be called from Update, and is called again each time until the player has answered.
+func (g *Game) askSaveCommit() {
+	if g.saveCommitAnswer == nil {
+		answer := make(chan bool, 1)
+		g.saveCommitAnswer = answer
+		go func() {
+			volume := g.gameAudioPlayer.Volume()
+			g.gameAudioPlayer.SetVolume(0)
+			answer <- zenity.Question(g.p.Sprintf("COMMIT_NETPLAY_SAVE"), zenity.Title("tango")) == nil
+			g.gameAudioPlayer.SetVolume(volume)
+		}()
+		return
+	}
+
+	var commit bool
+	select {
+	case commit = <-g.saveCommitAnswer:
+	default:
+		return
+	}
+	g.saveCommitAnswer = nil
+
+	g.commitSaveSandbox(commit)
+}
+
+// commitSaveSandbox puts the real save back, writing the sandbox to it if commit is set. The real save is backed up first, so netplay can never lose it.
+//
+// This must not be called from the mgba thread.
+func (g *Game) commitSaveSandbox(commit bool) {
+	g.t.Pause()
+	defer g.t.Unpause()
+
+	if commit && g.conf.Saves.Backups > 0 {
+		if err := backupSave(g.savePath, g.conf.Saves.Backups); err != nil {
+			log.Printf("failed to back up save file: %s", err)
+		}
+	}
+
+	atomic.StoreInt32(&g.saveCommitPending, 0)
+	g.unmaskSave(commit)
+}
+
+// unmaskSave puts the real save back, writing the sandbox to it if commit is set.
+//
+// This must be called from the mgba thread, or while it is paused.
+func (g *Game) unmaskSave(commit bool) {
+	if g.sandboxVF == nil {
+		return
+	}
+
+	g.mainCore.GBA().UnmaskSave(commit)
+	g.sandboxVF = nil
+	g.sandboxOriginal = nil
+
+	if commit {
+		log.Printf("save changes from netplay kept")
+	} else {
+		log.Printf("save changes from netplay discarded")
+	}
+}
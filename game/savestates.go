@@ -0,0 +1,192 @@
+package game
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/murkland/tango/mgba"
+)
+
+const numStateSlots = 10
+
+// stateSlotDisplayDuration is how long the current slot and its thumbnail stay on screen after they change.
+const stateSlotDisplayDuration = 2 * time.Second
+
+var errMatchActive = errors.New("savestates are disabled during a match")
+
+func (g *Game) statePath(slot int) string {
+	return filepath.Join("states", fmt.Sprintf("%s_%d.state", g.romName, slot))
+}
+
+func (g *Game) stateThumbnailPath(slot int) string {
+	return filepath.Join("states", fmt.Sprintf("%s_%d.png", g.romName, slot))
+}
+
+// thumbnail copies the last frame shown into an image.
+func (g *Game) thumbnail() *image.NRGBA {
+	g.vbPixMu.Lock()
+	defer g.vbPixMu.Unlock()
+
+	w, h := g.mainCore.DesiredVideoDimensions()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	copy(img.Pix, g.vbPix)
+	// The video buffer leaves alpha unset.
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+// saveState saves the current state into the current slot, along with a thumbnail of the screen.
+//
+// This must not be called from the mgba thread.
+func (g *Game) saveState() error {
+	// Pausing while a match is running could block on the netplay traps, so bail out early too.
+	if g.Match() != nil {
+		return errMatchActive
+	}
+
+	g.t.Pause()
+	defer g.t.Unpause()
+
+	// The match is set from the mgba thread, so now that it's paused, this can't race with a match starting.
+	if g.Match() != nil {
+		return errMatchActive
+	}
+
+	state := g.mainCore.SaveState()
+	if state == nil {
+		return errors.New("failed to save state")
+	}
+
+	if err := os.MkdirAll("states", 0o700); err != nil {
+		return err
+	}
+
+	if err := copyToFile(g.statePath(g.stateSlot), bytes.NewReader(state.Bytes())); err != nil {
+		return err
+	}
+
+	thumbnail := g.thumbnail()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, thumbnail); err != nil {
+		return err
+	}
+	if err := copyToFile(g.stateThumbnailPath(g.stateSlot), &buf); err != nil {
+		return err
+	}
+
+	g.stateSlotThumbnail = ebiten.NewImageFromImage(thumbnail)
+	log.Printf("saved state to slot %d", g.stateSlot)
+	return nil
+}
+
+// loadState loads the state in the current slot.
+//
+// This must not be called from the mgba thread.
+func (g *Game) loadState() error {
+	if g.Match() != nil {
+		return errMatchActive
+	}
+
+	raw, err := os.ReadFile(g.statePath(g.stateSlot))
+	if err != nil {
+		return err
+	}
+
+	if len(raw) != g.mainCore.StateSize() {
+		return fmt.Errorf("state is the wrong size: %d != %d", len(raw), g.mainCore.StateSize())
+	}
+
+	state := mgba.StateFromBytes(raw)
+	if state.ROMTitle != g.mainCore.GameTitle() || state.ROMCRC32 != g.mainCore.CRC32() {
+		return fmt.Errorf("state is for a different game: %s (%08x)", state.ROMTitle, state.ROMCRC32)
+	}
+
+	g.t.Pause()
+	defer g.t.Unpause()
+
+	if g.Match() != nil {
+		return errMatchActive
+	}
+
+	if !g.mainCore.LoadState(state) {
+		return errors.New("failed to load state")
+	}
+
+	// The snapshots are from a different timeline now.
+	g.clearRewind()
+
+	log.Printf("loaded state from slot %d", g.stateSlot)
+	return nil
+}
+
+// setStateSlot switches to another slot and shows it, with its thumbnail if it has one.
+func (g *Game) setStateSlot(slot int) {
+	g.stateSlot = (slot + numStateSlots) % numStateSlots
+	g.stateSlotShownUntil = time.Now().Add(stateSlotDisplayDuration)
+
+	g.stateSlotThumbnail = nil
+	f, err := os.Open(g.stateThumbnailPath(g.stateSlot))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		log.Printf("failed to load thumbnail for slot %d: %s", g.stateSlot, err)
+		return
+	}
+	g.stateSlotThumbnail = ebiten.NewImageFromImage(img)
+}
+
+func (g *Game) updateStates() {
+	if g.conf.Keymapping.PrevStateSlot != -1 && inpututil.IsKeyJustPressed(ebiten.Key(g.conf.Keymapping.PrevStateSlot)) {
+		g.setStateSlot(g.stateSlot - 1)
+	}
+
+	if g.conf.Keymapping.NextStateSlot != -1 && inpututil.IsKeyJustPressed(ebiten.Key(g.conf.Keymapping.NextStateSlot)) {
+		g.setStateSlot(g.stateSlot + 1)
+	}
+
+	if g.conf.Keymapping.SaveState != -1 && inpututil.IsKeyJustPressed(ebiten.Key(g.conf.Keymapping.SaveState)) {
+		if err := g.saveState(); err != nil {
+			log.Printf("failed to save state to slot %d: %s", g.stateSlot, err)
+		}
+		g.stateSlotShownUntil = time.Now().Add(stateSlotDisplayDuration)
+	}
+
+	if g.conf.Keymapping.LoadState != -1 && inpututil.IsKeyJustPressed(ebiten.Key(g.conf.Keymapping.LoadState)) {
+		if err := g.loadState(); err != nil {
+			log.Printf("failed to load state from slot %d: %s", g.stateSlot, err)
+		}
+		g.stateSlotShownUntil = time.Now().Add(stateSlotDisplayDuration)
+	}
+}
+
+func (g *Game) drawStateSlot(screen *ebiten.Image) {
+	if time.Now().After(g.stateSlotShownUntil) {
+		return
+	}
+
+	bounds := screen.Bounds()
+	if g.stateSlotThumbnail != nil {
+		opts := &ebiten.DrawImageOptions{}
+		w, h := g.stateSlotThumbnail.Size()
+		opts.GeoM.Translate(float64(bounds.Dx()-w-4), float64(bounds.Dy()-h-4))
+		screen.DrawImage(g.stateSlotThumbnail, opts)
+	}
+	text.Draw(screen, fmt.Sprintf("slot %d", g.stateSlot), mplusNormalFont, 4, bounds.Dy()-4, color.RGBA{0xff, 0xff, 0xff, 0xff})
+}
@@ -14,10 +14,13 @@ import (
 )
 
 type Battle struct {
-	number int
-	isP2   bool
+	number    int
+	isP2      bool
+	startTime time.Time
+	result    replay.Result
 
-	rw *replay.Writer
+	rw         *replay.Writer
+	replayPath string
 
 	iq *input.Queue
 
@@ -36,7 +39,7 @@ type Battle struct {
 	committedState *mgba.State
 }
 
-func (m *Match) NewBattle(core *mgba.Core) error {
+func (m *Match) NewBattle(core mgba.Emulator) error {
 	m.battleMu.Lock()
 	defer m.battleMu.Unlock()
 
@@ -47,8 +50,9 @@ func (m *Match) NewBattle(core *mgba.Core) error {
 	inputDelay := m.conf.Netplay.InputDelay
 
 	b := &Battle{
-		number: m.battleNumber,
-		isP2:   !m.wonLastBattle,
+		number:    m.battleNumber,
+		isP2:      !m.wonLastBattle,
+		startTime: time.Now(),
 
 		stateCommittedCh: make(chan struct{}),
 
@@ -57,14 +61,15 @@ func (m *Match) NewBattle(core *mgba.Core) error {
 
 	b.iq = input.NewQueue(60, inputDelay, b.LocalPlayerIndex())
 
-	fn := filepath.Join("replays", fmt.Sprintf("%s_p%d.tangoreplay", time.Now().Format("20060102030405"), b.LocalPlayerIndex()+1))
+	fn := filepath.Join("replays", fmt.Sprintf("%s_p%d.tangoreplay", b.startTime.Format("20060102030405"), b.LocalPlayerIndex()+1))
 	log.Printf("writing replay: %s", fn)
 
-	il, err := replay.NewWriter(fn, core)
+	il, err := replay.NewWriter(fn, m.conf.Replay.KeyframeInterval)
 	if err != nil {
 		return err
 	}
 	b.rw = il
+	b.replayPath = fn
 	m.battle = b
 	log.Printf("battle %d started, won last battle (is p1) = %t", m.battleNumber, m.wonLastBattle)
 	return nil
@@ -85,11 +90,14 @@ func (b *Battle) QueueLength(playerIndex int) int {
 	return b.iq.QueueLength(playerIndex)
 }
 
+// Close writes the result and closes the replay. The replay is closed even if the result couldn't be written, and the first error is returned.
 func (b *Battle) Close() error {
-	if err := b.rw.Close(); err != nil {
-		return err
+	writeErr := b.rw.WriteResult(b.result)
+	closeErr := b.rw.Close()
+	if writeErr != nil {
+		return writeErr
 	}
-	return nil
+	return closeErr
 }
 
 func (b *Battle) SetCommittedState(state *mgba.State) {
@@ -150,6 +158,10 @@ func (b *Battle) ReplayWriter() *replay.Writer {
 	return b.rw
 }
 
+func (b *Battle) SetResult(result replay.Result) {
+	b.result = result
+}
+
 func (b *Battle) IsP2() bool {
 	return b.isP2
 }
@@ -1,6 +1,7 @@
 package match
 
 import (
+	"bytes"
 	"context"
 	cryptorand "crypto/rand"
 	"encoding/hex"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"path/filepath"
 	"sync"
 
 	"github.com/murkland/clone"
@@ -18,6 +20,7 @@ import (
 	"github.com/murkland/tango/config"
 	"github.com/murkland/tango/input"
 	"github.com/murkland/tango/packets"
+	"github.com/murkland/tango/replay"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -31,11 +34,12 @@ var (
 )
 
 type Match struct {
-	conf      config.Config
-	sessionID string
-	matchType uint16
-	gameTitle string
-	gameCRC32 uint32
+	conf         config.Config
+	tangoVersion string
+	sessionID    string
+	matchType    uint16
+	gameTitle    string
+	gameCRC32    uint32
 
 	cancel context.CancelFunc
 
@@ -44,6 +48,10 @@ type Match struct {
 	dc               *ctxwebrtc.DataChannel
 	wonLastBattle    bool
 	randSource       rand.Source
+	seed             []byte
+	hellos           [2][]byte
+
+	matchWriter *replay.MatchWriter
 
 	battleMu     sync.Mutex
 	battleNumber int
@@ -73,13 +81,14 @@ func (m *Match) Aborted() bool {
 	return m.aborted
 }
 
-func New(conf config.Config, sessionID string, matchType uint16, gameTitle string, gameCRC32 uint32) *Match {
+func New(conf config.Config, tangoVersion string, sessionID string, matchType uint16, gameTitle string, gameCRC32 uint32) *Match {
 	return &Match{
-		conf:      conf,
-		sessionID: sessionID,
-		matchType: matchType,
-		gameTitle: gameTitle,
-		gameCRC32: gameCRC32,
+		conf:         conf,
+		tangoVersion: tangoVersion,
+		sessionID:    sessionID,
+		matchType:    matchType,
+		gameTitle:    gameTitle,
+		gameCRC32:    gameCRC32,
 
 		negotiationErrCh: make(chan error),
 
@@ -183,12 +192,20 @@ func (m *Match) negotiate(ctx context.Context) error {
 	m.peerConn = peerConn
 	m.dc = dc
 	m.randSource = randSource
+	m.seed = seed
+	m.hellos = [2][]byte{marshalPacket(helloPacket), marshalPacket(theirHello)}
 	rng := rand.New(m.randSource)
 	m.wonLastBattle = (rng.Int31n(2) == 1) == (connectionSide == signorclient.ConnectionSideOfferer)
 	log.Printf("negotiation complete!")
 	return nil
 }
 
+func marshalPacket(packet packets.Packet) []byte {
+	var buf bytes.Buffer
+	packets.Marshal(packet, &buf)
+	return buf.Bytes()
+}
+
 func (m *Match) handleConn(ctx context.Context) error {
 	for {
 		packet, trailer, err := packets.Recv(ctx, m.dc)
@@ -241,11 +258,32 @@ func (m *Match) endBattleLocked() error {
 	if err := m.battle.Close(); err != nil {
 		return err
 	}
+
+	if m.conf.Replay.SaveMatches {
+		if err := m.appendBattleToMatchReplay(m.battle); err != nil {
+			log.Printf("failed to save battle to match replay: %s", err)
+		}
+	}
+
 	m.battle = nil
 	m.battleNumber++
 	return nil
 }
 
+func (m *Match) appendBattleToMatchReplay(b *Battle) error {
+	if m.matchWriter == nil {
+		fn := filepath.Join("replays", fmt.Sprintf("%s_match.tangomatch", b.startTime.Format("20060102030405")))
+		log.Printf("writing match replay: %s", fn)
+
+		mw, err := replay.NewMatchWriter(fn, m.seed, m.hellos)
+		if err != nil {
+			return err
+		}
+		m.matchWriter = mw
+	}
+	return m.matchWriter.AppendBattle(b.replayPath)
+}
+
 func (m *Match) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	m.cancel = cancel
@@ -267,6 +305,12 @@ func (m *Match) Close() error {
 	if m.battle != nil {
 		m.endBattleLocked()
 	}
+	if m.matchWriter != nil {
+		if err := m.matchWriter.Close(); err != nil {
+			return err
+		}
+		m.matchWriter = nil
+	}
 	if m.dc != nil {
 		if err := m.dc.Close(); err != nil {
 			return err
@@ -335,3 +379,22 @@ func (m *Match) RandSource() rand.Source {
 func (m *Match) Type() uint16 {
 	return m.matchType
 }
+
+func (m *Match) ReplayMetadata() replay.Metadata {
+	battle := m.Battle()
+
+	var inputDelays [2]int
+	inputDelays[battle.LocalPlayerIndex()] = battle.LocalDelay()
+	inputDelays[battle.RemotePlayerIndex()] = battle.RemoteDelay()
+
+	return replay.Metadata{
+		TangoVersion: m.tangoVersion,
+		ROMTitle:     m.gameTitle,
+		ROMCRC32:     m.gameCRC32,
+		MatchType:    m.matchType,
+		BattleNumber: battle.number,
+		InputDelays:  inputDelays,
+		StartTime:    battle.startTime,
+		SessionID:    m.sessionID,
+	}
+}
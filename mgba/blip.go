@@ -27,3 +27,7 @@ func (b *Blip) ReadSamples(out unsafe.Pointer, count int, stereo bool) int {
 	}
 	return int(C.blip_read_samples(b.ptr, (*C.short)(out), C.int(count), C.int(stereoI)))
 }
+
+func (b *Blip) Clear() {
+	C.blip_clear(b.ptr)
+}
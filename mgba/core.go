@@ -93,8 +93,9 @@ type CoreOptions struct {
 }
 
 type Core struct {
-	ptr    *C.struct_mCore
-	config *Config
+	ptr     *C.struct_mCore
+	config  *Config
+	trapper *Trapper
 }
 
 func NewGBACore() (*Core, error) {
@@ -103,7 +104,7 @@ func NewGBACore() (*Core, error) {
 		return nil, errors.New("could not create core")
 	}
 
-	core := &Core{ptr, &Config{&ptr.config, false}}
+	core := &Core{ptr: ptr, config: &Config{&ptr.config, false}}
 
 	if !C.tango_mgba_mCore_init(core.ptr) {
 		return nil, errors.New("could not initialize core")
@@ -0,0 +1,83 @@
+package mgba
+
+// Memory is raw access to the bus, which does not tick the clock or trigger any I/O side effects.
+type Memory interface {
+	RawRead8(address uint32, segment int) uint8
+	RawRead16(address uint32, segment int) uint16
+	RawRead32(address uint32, segment int) uint32
+	RawReadRange(address uint32, segment int, buf []byte)
+	RawWrite8(address uint32, segment int, v uint8)
+	RawWrite16(address uint32, segment int, v uint16)
+	RawWrite32(address uint32, segment int, v uint32)
+	RawWriteRange(address uint32, segment int, buf []byte)
+}
+
+// Emulator is the part of an emulated GBA that the netplay and replay logic drives.
+//
+// Core is the real implementation. Anything else that implements it, such as a scripted fake, can stand in for a core so that logic can run without a ROM.
+type Emulator interface {
+	Memory
+
+	GameTitle() string
+	CRC32() uint32
+
+	Register(r int) uint32
+	SetRegister(r int, v uint32)
+	// ThumbWritePC must be called after setting the PC while in Thumb mode, to refill the pipeline.
+	ThumbWritePC()
+
+	SaveState() *State
+	LoadState(state *State) bool
+
+	Reset()
+	RunFrame()
+	// SetFPSTarget sets how many frames per second the emulator is synced to, if it is synced at all.
+	SetFPSTarget(fps float32)
+
+	// AddTrap calls handler whenever the Thumb instruction at addr is reached. By the time handler is called, the instruction has already run.
+	AddTrap(addr uint32, handler func()) TrapHandle
+}
+
+// TrapHandle is a trap added with Emulator.AddTrap, which can be disabled or removed later.
+type TrapHandle interface {
+	Enable()
+	Disable()
+	Enabled() bool
+	Remove()
+}
+
+var _ Emulator = (*Core)(nil)
+var _ TrapHandle = (*Trap)(nil)
+
+func (c *Core) Register(r int) uint32 {
+	return c.GBA().Register(r)
+}
+
+func (c *Core) SetRegister(r int, v uint32) {
+	c.GBA().SetRegister(r, v)
+}
+
+func (c *Core) ThumbWritePC() {
+	c.GBA().ThumbWritePC()
+}
+
+func (c *Core) SetFPSTarget(fps float32) {
+	if sync := c.GBA().Sync(); sync != nil {
+		sync.SetFPSTarget(fps)
+	}
+}
+
+// Trapper returns the core's own trapper, attaching it the first time it is asked for.
+//
+// A core only has room for one trapper, so this must not be mixed with attaching another one by hand.
+func (c *Core) Trapper() *Trapper {
+	if c.trapper == nil {
+		c.trapper = NewTrapper(c)
+		c.trapper.Attach(c.GBA())
+	}
+	return c.trapper
+}
+
+func (c *Core) AddTrap(addr uint32, handler func()) TrapHandle {
+	return c.Trapper().Add(addr, handler)
+}
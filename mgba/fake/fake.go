@@ -0,0 +1,262 @@
+// Package fake is a scripted stand-in for an mgba.Core, so netplay and replay logic can be driven without a ROM.
+package fake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/murkland/tango/mgba"
+)
+
+// Core is a fake emulator. Instead of running code, each frame it reaches the addresses its script gives for that frame, calling any traps on them.
+//
+// Memory starts out zeroed and is only as big as what is written to it.
+type Core struct {
+	title string
+	crc32 uint32
+
+	// Script returns the addresses reached during the given frame, in order. Frames are counted from 0 and are saved and loaded along with the rest of the state.
+	Script func(frame int) []uint32
+
+	mem       map[uint32]uint8
+	registers [16]uint32
+	frame     int
+	fpsTarget float32
+
+	traps map[uint32][]*Trap
+}
+
+var _ mgba.Emulator = (*Core)(nil)
+
+func New(title string, crc32 uint32, script func(frame int) []uint32) *Core {
+	return &Core{
+		title:  title,
+		crc32:  crc32,
+		Script: script,
+		mem:    map[uint32]uint8{},
+		traps:  map[uint32][]*Trap{},
+	}
+}
+
+func (c *Core) GameTitle() string {
+	return c.title
+}
+
+func (c *Core) CRC32() uint32 {
+	return c.crc32
+}
+
+// FrameCounter returns the frame that will be run next.
+func (c *Core) FrameCounter() int {
+	return c.frame
+}
+
+// FPSTarget returns what the FPS target was last set to.
+func (c *Core) FPSTarget() float32 {
+	return c.fpsTarget
+}
+
+func (c *Core) SetFPSTarget(fps float32) {
+	c.fpsTarget = fps
+}
+
+func (c *Core) RawRead8(address uint32, segment int) uint8 {
+	return c.mem[address]
+}
+
+func (c *Core) RawRead16(address uint32, segment int) uint16 {
+	var buf [2]byte
+	c.RawReadRange(address, segment, buf[:])
+	return binary.LittleEndian.Uint16(buf[:])
+}
+
+func (c *Core) RawRead32(address uint32, segment int) uint32 {
+	var buf [4]byte
+	c.RawReadRange(address, segment, buf[:])
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+func (c *Core) RawReadRange(address uint32, segment int, buf []byte) {
+	for i := range buf {
+		buf[i] = c.mem[address+uint32(i)]
+	}
+}
+
+func (c *Core) RawWrite8(address uint32, segment int, v uint8) {
+	c.mem[address] = v
+}
+
+func (c *Core) RawWrite16(address uint32, segment int, v uint16) {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	c.RawWriteRange(address, segment, buf[:])
+}
+
+func (c *Core) RawWrite32(address uint32, segment int, v uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	c.RawWriteRange(address, segment, buf[:])
+}
+
+func (c *Core) RawWriteRange(address uint32, segment int, buf []byte) {
+	for i, b := range buf {
+		c.mem[address+uint32(i)] = b
+	}
+}
+
+func (c *Core) Register(r int) uint32 {
+	return c.registers[r]
+}
+
+func (c *Core) SetRegister(r int, v uint32) {
+	c.registers[r] = v
+}
+
+// ThumbWritePC does nothing, since there is no pipeline to refill.
+func (c *Core) ThumbWritePC() {
+}
+
+// SaveState saves the memory, registers and frame counter after a blank GBA state, so the state is the same size as a real one would be and the real state's fields are all zero.
+//
+// Fake state is:
+// u32: frame
+// u32[16]: registers
+// u32: number of bytes of memory
+// memory entry (one per byte, by ascending address):
+// u32: address
+// u8: value
+func (c *Core) SaveState() *mgba.State {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, mgba.SerializedStateSize))
+
+	addrs := make([]uint32, 0, len(c.mem))
+	for addr := range c.mem {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	binary.Write(&buf, binary.LittleEndian, uint32(c.frame))
+	binary.Write(&buf, binary.LittleEndian, c.registers)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(addrs)))
+	for _, addr := range addrs {
+		binary.Write(&buf, binary.LittleEndian, addr)
+		buf.WriteByte(c.mem[addr])
+	}
+	return mgba.StateFromBytes(buf.Bytes())
+}
+
+// LoadState loads a state saved by SaveState. It returns false if the state is not one.
+func (c *Core) LoadState(state *mgba.State) bool {
+	raw := state.Bytes()
+	if len(raw) < mgba.SerializedStateSize {
+		return false
+	}
+	r := bytes.NewReader(raw[mgba.SerializedStateSize:])
+
+	var frame uint32
+	var registers [16]uint32
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &frame); err != nil {
+		return false
+	}
+	if err := binary.Read(r, binary.LittleEndian, &registers); err != nil {
+		return false
+	}
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return false
+	}
+
+	mem := make(map[uint32]uint8, n)
+	for i := uint32(0); i < n; i++ {
+		var addr uint32
+		if err := binary.Read(r, binary.LittleEndian, &addr); err != nil {
+			return false
+		}
+		v, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		mem[addr] = v
+	}
+
+	c.mem = mem
+	c.registers = registers
+	c.frame = int(frame)
+	return true
+}
+
+// Reset clears memory and registers and starts the script over.
+func (c *Core) Reset() {
+	c.mem = map[uint32]uint8{}
+	c.registers = [16]uint32{}
+	c.frame = 0
+}
+
+// RunFrame reaches each address the script gives for the current frame. As on a real core, the PC is 4 bytes past the address while its traps run, and a trap may move it.
+func (c *Core) RunFrame() {
+	frame := c.frame
+	c.frame++
+
+	if c.Script == nil {
+		return
+	}
+	for _, addr := range c.Script(frame) {
+		c.registers[15] = addr + 4
+		// Handlers may add or remove traps here, so work from a copy.
+		for _, tr := range append([]*Trap{}, c.traps[addr]...) {
+			if tr.enabled {
+				tr.handler()
+			}
+		}
+	}
+}
+
+func (c *Core) AddTrap(addr uint32, handler func()) mgba.TrapHandle {
+	tr := &Trap{c: c, addr: addr, handler: handler, enabled: true}
+	c.traps[addr] = append(c.traps[addr], tr)
+	return tr
+}
+
+// Trap is a handler added with AddTrap.
+type Trap struct {
+	c       *Core
+	addr    uint32
+	handler func()
+	enabled bool
+	removed bool
+}
+
+var _ mgba.TrapHandle = (*Trap)(nil)
+
+func (tr *Trap) Enable() {
+	tr.enabled = !tr.removed
+}
+
+func (tr *Trap) Disable() {
+	tr.enabled = false
+}
+
+func (tr *Trap) Enabled() bool {
+	return tr.enabled
+}
+
+// Remove removes the trap for good. It can't be enabled again.
+func (tr *Trap) Remove() {
+	if tr.removed {
+		return
+	}
+	tr.removed = true
+	tr.enabled = false
+
+	traps := tr.c.traps[tr.addr]
+	for i, other := range traps {
+		if other == tr {
+			tr.c.traps[tr.addr] = append(traps[:i:i], traps[i+1:]...)
+			break
+		}
+	}
+	if len(tr.c.traps[tr.addr]) == 0 {
+		delete(tr.c.traps, tr.addr)
+	}
+}
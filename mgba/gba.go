@@ -6,6 +6,7 @@ package mgba
 */
 import "C"
 import (
+	"errors"
 	"unsafe"
 )
 
@@ -64,14 +65,60 @@ func (g *GBA) ThumbPrefetchCycles() int {
 	return int(1 + g.ptr.cpu.memory.activeSeqCycles16)
 }
 
-func (g *GBA) ARMRunFake(opcode uint16) {
+func (g *GBA) ARMPrefetchCycles() int {
+	return int(1 + g.ptr.cpu.memory.activeSeqCycles32)
+}
+
+func (g *GBA) ARMRunFake(opcode uint32) {
 	C.ARMRunFake(g.ptr.cpu, C.uint32_t(opcode))
 }
 
+// Step runs a single instruction, handling any events that are due first.
+func (g *GBA) Step() {
+	C.ARMRun(g.ptr.cpu)
+}
+
+// ThumbMode returns whether the CPU is executing Thumb instructions, rather than ARM ones.
+func (g *GBA) ThumbMode() bool {
+	return g.ptr.cpu.executionMode == C.MODE_THUMB
+}
+
 func (g *GBA) ThumbWritePC() {
 	g.SetCPUCycles(g.ThumbPrefetchCycles() + int(C.ThumbWritePC(g.ptr.cpu)))
 }
 
+func (g *GBA) ARMWritePC() {
+	g.SetCPUCycles(g.ARMPrefetchCycles() + int(C.ARMWritePC(g.ptr.cpu)))
+}
+
+// MaskSave puts the save behind an in-memory copy of it, so nothing the game writes reaches the real save until UnmaskSave. The returned VFile holds the copy, and the returned bytes are what the copy started out as.
+func (g *GBA) MaskSave() (*VFile, []byte, error) {
+	vf := NewMemVF(nil)
+	if vf == nil {
+		return nil, nil, errors.New("could not create in-memory save")
+	}
+
+	if !C.GBASavedataClone(&g.ptr.memory.savedata, vf.ptr) {
+		vf.Close()
+		return nil, nil, errors.New("could not copy save")
+	}
+
+	original, err := vf.Bytes()
+	if err != nil {
+		vf.Close()
+		return nil, nil, err
+	}
+
+	C.GBASavedataMask(&g.ptr.memory.savedata, vf.ptr, false)
+	return vf, original, nil
+}
+
+// UnmaskSave puts the real save back, first writing the in-memory copy to it if writeback is set. The VFile returned by MaskSave is closed and must not be used afterwards.
+func (g *GBA) UnmaskSave(writeback bool) {
+	g.ptr.memory.savedata.maskWriteback = C.bool(writeback)
+	C.GBASavedataUnmask(&g.ptr.memory.savedata)
+}
+
 func GBAAudioCalculateRatio(inputSampleRate float32, desiredFPS float32, desiredSampleRate float32) float32 {
 	return float32(C.GBAAudioCalculateRatio(C.float(inputSampleRate), C.float(desiredFPS), C.float(desiredSampleRate)))
 }
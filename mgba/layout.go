@@ -0,0 +1,294 @@
+package mgba
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LayoutField is a single field of a struct in memory.
+type LayoutField struct {
+	Name   string
+	Offset uint32
+	// Width is the size of each element in bytes: 1, 2 or 4.
+	Width int
+	// Count is the number of elements, which is 1 unless the field is an array.
+	Count int
+
+	index []int
+}
+
+// Layout describes where the fields of a Go struct live in memory.
+//
+// Fields are described with a mem struct tag holding their offset from the start of the struct, e.g.:
+//
+//	type BattleState struct {
+//		LocalWins uint8 `mem:"0x18"`
+//	}
+//
+// Fields must be 8, 16 or 32-bit integers, bools, arrays of those, or structs that are laid out the same way. Fields without a mem tag are skipped.
+type Layout struct {
+	Name   string
+	Fields []LayoutField
+
+	fieldsByName map[string]int
+}
+
+var layoutCache sync.Map
+
+// LayoutOf returns the layout of the struct type t.
+func LayoutOf(t reflect.Type) (*Layout, error) {
+	if l, ok := layoutCache.Load(t); ok {
+		return l.(*Layout), nil
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", t)
+	}
+
+	l := &Layout{Name: t.Name(), fieldsByName: map[string]int{}}
+	if err := l.addFields(t, 0, "", nil); err != nil {
+		return nil, err
+	}
+	for i, f := range l.Fields {
+		l.fieldsByName[f.Name] = i
+	}
+
+	layoutCache.Store(t, l)
+	return l, nil
+}
+
+func (l *Layout) addFields(t reflect.Type, base uint32, prefix string, index []int) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("mem")
+		if !ok {
+			continue
+		}
+
+		offset, err := strconv.ParseUint(tag, 0, 32)
+		if err != nil {
+			return fmt.Errorf("%s.%s: bad offset %q: %w", t.Name(), f.Name, tag, err)
+		}
+
+		fieldIndex := append(append([]int(nil), index...), i)
+		name := prefix + f.Name
+
+		if f.Type.Kind() == reflect.Struct {
+			if err := l.addFields(f.Type, base+uint32(offset), name+".", fieldIndex); err != nil {
+				return err
+			}
+			continue
+		}
+
+		elemType := f.Type
+		count := 1
+		if f.Type.Kind() == reflect.Array {
+			elemType = f.Type.Elem()
+			count = f.Type.Len()
+		}
+
+		width, err := layoutWidth(elemType)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+
+		l.Fields = append(l.Fields, LayoutField{
+			Name:   name,
+			Offset: base + uint32(offset),
+			Width:  width,
+			Count:  count,
+			index:  fieldIndex,
+		})
+	}
+	return nil
+}
+
+// Field returns the field with the given name. Fields of nested structs are named like "Outer.Inner".
+func (l *Layout) Field(name string) (LayoutField, bool) {
+	i, ok := l.fieldsByName[name]
+	if !ok {
+		return LayoutField{}, false
+	}
+	return l.Fields[i], true
+}
+
+func layoutWidth(t reflect.Type) (int, error) {
+	switch t.Kind() {
+	case reflect.Uint8, reflect.Int8, reflect.Bool:
+		return 1, nil
+	case reflect.Uint16, reflect.Int16:
+		return 2, nil
+	case reflect.Uint32, reflect.Int32:
+		return 4, nil
+	}
+	return 0, fmt.Errorf("unsupported type %s", t)
+}
+
+func structValue(v interface{}) (reflect.Value, *Layout, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return reflect.Value{}, nil, fmt.Errorf("expected a non-nil pointer to a struct, got %T", v)
+	}
+	rv = rv.Elem()
+
+	l, err := LayoutOf(rv.Type())
+	if err != nil {
+		return reflect.Value{}, nil, err
+	}
+	return rv, l, nil
+}
+
+func setLayoutValue(v reflect.Value, raw uint32) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(raw != 0)
+	case reflect.Int8:
+		v.SetInt(int64(int8(raw)))
+	case reflect.Int16:
+		v.SetInt(int64(int16(raw)))
+	case reflect.Int32:
+		v.SetInt(int64(int32(raw)))
+	default:
+		v.SetUint(uint64(raw))
+	}
+}
+
+func getLayoutValue(v reflect.Value) uint32 {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return 1
+		}
+		return 0
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return uint32(v.Int())
+	default:
+		return uint32(v.Uint())
+	}
+}
+
+func rawReadWidth(m Memory, address uint32, width int) uint32 {
+	switch width {
+	case 1:
+		return uint32(m.RawRead8(address, -1))
+	case 2:
+		return uint32(m.RawRead16(address, -1))
+	default:
+		return m.RawRead32(address, -1)
+	}
+}
+
+func rawWriteWidth(m Memory, address uint32, width int, v uint32) {
+	switch width {
+	case 1:
+		m.RawWrite8(address, -1, uint8(v))
+	case 2:
+		m.RawWrite16(address, -1, uint16(v))
+	default:
+		m.RawWrite32(address, -1, v)
+	}
+}
+
+func layoutElem(v reflect.Value, i int) reflect.Value {
+	if v.Kind() == reflect.Array {
+		return v.Index(i)
+	}
+	return v
+}
+
+// ReadStruct reads the struct at address into v, which must be a pointer to a struct with a layout (see Layout).
+func ReadStruct(m Memory, address uint32, v interface{}) error {
+	rv, l, err := structValue(v)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range l.Fields {
+		fv := rv.FieldByIndex(f.index)
+		for i := 0; i < f.Count; i++ {
+			setLayoutValue(layoutElem(fv, i), rawReadWidth(m, address+f.Offset+uint32(i*f.Width), f.Width))
+		}
+	}
+	return nil
+}
+
+// WriteStruct writes every field of v to the struct at address. Memory not covered by a field is left alone.
+func WriteStruct(m Memory, address uint32, v interface{}) error {
+	rv, l, err := structValue(v)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range l.Fields {
+		fv := rv.FieldByIndex(f.index)
+		for i := 0; i < f.Count; i++ {
+			rawWriteWidth(m, address+f.Offset+uint32(i*f.Width), f.Width, getLayoutValue(layoutElem(fv, i)))
+		}
+	}
+	return nil
+}
+
+// FormatStruct formats v, as read from address, with the address of each field, for debugging.
+func FormatStruct(address uint32, v interface{}) string {
+	rv, l, err := structValue(v)
+	if err != nil {
+		return fmt.Sprintf("<%s>", err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s @ 0x%08x\n", l.Name, address)
+	for _, f := range l.Fields {
+		fv := rv.FieldByIndex(f.index)
+		vals := make([]string, f.Count)
+		for i := 0; i < f.Count; i++ {
+			vals[i] = fmt.Sprintf("0x%0*x", f.Width*2, getLayoutValue(layoutElem(fv, i))&uint32(uint64(1)<<(f.Width*8)-1))
+		}
+		val := vals[0]
+		if fv.Kind() == reflect.Array {
+			val = "[" + strings.Join(vals, " ") + "]"
+		}
+		fmt.Fprintf(&sb, "  0x%08x +0x%02x %-24s %s\n", address+f.Offset, f.Offset, f.Name, val)
+	}
+	return sb.String()
+}
+
+// WriteField writes only the named field of v to the struct at address, leaving the rest of the struct alone.
+//
+// A single element of an array field can be written by naming it with its index, e.g. "PlayerCustomScreenStates[1]".
+func WriteField(m Memory, address uint32, v interface{}, name string) error {
+	rv, l, err := structValue(v)
+	if err != nil {
+		return err
+	}
+
+	fieldName := name
+	first, last := 0, -1
+	if i := strings.IndexByte(name, '['); i != -1 && strings.HasSuffix(name, "]") {
+		fieldName = name[:i]
+		elem, err := strconv.Atoi(name[i+1 : len(name)-1])
+		if err != nil {
+			return fmt.Errorf("%s: bad field name %q: %w", l.Name, name, err)
+		}
+		first, last = elem, elem
+	}
+
+	f, ok := l.Field(fieldName)
+	if !ok {
+		return fmt.Errorf("%s has no field %q", l.Name, fieldName)
+	}
+
+	if last == -1 {
+		last = f.Count - 1
+	} else if first < 0 || first >= f.Count || rv.FieldByIndex(f.index).Kind() != reflect.Array {
+		return fmt.Errorf("%s: no element %q", l.Name, name)
+	}
+
+	fv := rv.FieldByIndex(f.index)
+	for i := first; i <= last; i++ {
+		rawWriteWidth(m, address+f.Offset+uint32(i*f.Width), f.Width, getLayoutValue(layoutElem(fv, i)))
+	}
+	return nil
+}
@@ -23,6 +23,9 @@ import (
 	"unsafe"
 )
 
+// SerializedStateSize is the size of a GBA state, as passed to StateFromBytes.
+const SerializedStateSize = int(C.sizeof_struct_GBASerializedState)
+
 type State struct {
 	ROMTitle string
 	ROMCRC32 uint32
@@ -46,8 +49,13 @@ func toState(buf unsafe.Pointer, size int) *State {
 	return s
 }
 
+// StateSize returns how big a state saved by this core is.
+func (c *Core) StateSize() int {
+	return int(C.tango_mgba_mCore_stateSize(c.ptr))
+}
+
 func (c *Core) SaveState() *State {
-	size := int(C.tango_mgba_mCore_stateSize(c.ptr))
+	size := c.StateSize()
 	buf := unsafe.Pointer(C.malloc(C.size_t(size)))
 	ok := C.tango_mgba_mCore_saveState(c.ptr, buf)
 	if !ok {
@@ -17,6 +17,15 @@ func (s *Sync) SetFPSTarget(fpsTarget float32) {
 	s.ptr.fpsTarget = C.float(fpsTarget)
 }
 
+func (s *Sync) AudioWait() bool {
+	return bool(s.ptr.audioWait)
+}
+
+// SetAudioWait sets whether the emulator waits for its audio to be played before producing more. This is what keeps it running at the FPS target, so without it the emulator runs as fast as it can.
+func (s *Sync) SetAudioWait(wait bool) {
+	s.ptr.audioWait = C.bool(wait)
+}
+
 func (s *Sync) LockAudio() {
 	C.mCoreSyncLockAudio(s.ptr)
 }
@@ -9,12 +9,13 @@ package mgba
 struct Trapper {
 	struct mCPUComponent cpuComponent;
 	void (*realBkpt16)(struct ARMCore* cpu, int immediate);
+	void (*realBkpt32)(struct ARMCore* cpu, int immediate);
 	void* userData;
 };
 
 extern void tango_Trapper_initCallback(void* cpu, struct mCPUComponent* component);
 extern void tango_Trapper_deinitCallback(struct mCPUComponent* component);
-extern void tango_Trapper_handle(struct Trapper* component);
+extern void tango_Trapper_handle(struct Trapper* component, bool arm);
 
 static void tango_mCPUComponent_setCallbacks_Trapper(struct mCPUComponent* cpuComponent) {
 	cpuComponent->init = &tango_Trapper_initCallback;
@@ -25,14 +26,25 @@ static void tango_Trapper_bkpt16(struct ARMCore* cpu, int immediate) {
 	struct GBA* gba = (struct GBA*) cpu->master;
 	struct Trapper* component = (struct Trapper*) gba->cpu->components[CPU_COMPONENT_MISC_1];
 	if (immediate == TANGO_TRAPPER_IMM) {
-		tango_Trapper_handle(component);
+		tango_Trapper_handle(component, false);
 		return;
 	}
 	component->realBkpt16(cpu, immediate);
 }
 
-static void tango_mgba_ARMInterruptHandler_setBkpt16_Trapper(struct ARMInterruptHandler* irqh) {
+static void tango_Trapper_bkpt32(struct ARMCore* cpu, int immediate) {
+	struct GBA* gba = (struct GBA*) cpu->master;
+	struct Trapper* component = (struct Trapper*) gba->cpu->components[CPU_COMPONENT_MISC_1];
+	if (immediate == TANGO_TRAPPER_IMM) {
+		tango_Trapper_handle(component, true);
+		return;
+	}
+	component->realBkpt32(cpu, immediate);
+}
+
+static void tango_mgba_ARMInterruptHandler_setBkpts_Trapper(struct ARMInterruptHandler* irqh) {
 	irqh->bkpt16 = tango_Trapper_bkpt16;
+	irqh->bkpt32 = tango_Trapper_bkpt32;
 }
 */
 import "C"
@@ -58,26 +70,94 @@ func tango_Trapper_deinitCallback(component *C.struct_mCPUComponent) {
 }
 
 //export tango_Trapper_handle
-func tango_Trapper_handle(component *C.struct_Trapper) {
+func tango_Trapper_handle(component *C.struct_Trapper, arm C.bool) {
 	handle := *(*cgo.Handle)(component.userData)
 	t := handle.Value().(*Trapper)
-	t.Handle()
+	t.Handle(bool(arm))
 }
 
-type trap struct {
-	original uint16
+const (
+	thumbBkptOpcode = 0xbe00 | C.TANGO_TRAPPER_IMM
+	// The ARM encoding splits the immediate into bits 8-19 and 0-3.
+	armBkptOpcode = 0xe1200070 | (C.TANGO_TRAPPER_IMM&0xfff0)<<4 | C.TANGO_TRAPPER_IMM&0xf
+)
+
+// Trap is a single handler at a trapped address.
+type Trap struct {
+	t        *Trapper
+	addr     uint32
+	priority int
 	handler  func()
+	enabled  bool
+	removed  bool
+}
+
+// Enable re-arms a disabled trap.
+func (tr *Trap) Enable() {
+	if tr.removed || tr.enabled {
+		return
+	}
+	tr.enabled = true
+	tr.t.sync(tr.addr)
+}
+
+// Disable stops the trap's handler from being called until it is enabled again. If no other handlers at the address are enabled, the original instruction is put back.
+func (tr *Trap) Disable() {
+	if tr.removed || !tr.enabled {
+		return
+	}
+	tr.enabled = false
+	tr.t.sync(tr.addr)
 }
 
+func (tr *Trap) Enabled() bool {
+	return tr.enabled
+}
+
+// Remove removes the trap for good.
+func (tr *Trap) Remove() {
+	if tr.removed {
+		return
+	}
+	tr.removed = true
+	tr.enabled = false
+
+	site := tr.t.sites[tr.addr]
+	for i, other := range site.traps {
+		if other == tr {
+			site.traps = append(site.traps[:i:i], site.traps[i+1:]...)
+			break
+		}
+	}
+	tr.t.sync(tr.addr)
+	if len(site.traps) == 0 {
+		delete(tr.t.sites, tr.addr)
+	}
+}
+
+// trapSite is every trap at a single address.
+type trapSite struct {
+	arm      bool
+	original uint32
+	patched  bool
+	// traps is sorted by descending priority, and then by the order they were added in.
+	traps []*Trap
+}
+
+// Trapper calls Go functions when the CPU reaches given addresses, by patching breakpoint instructions into the ROM.
+//
+// Traps may be added, removed, enabled and disabled at any time the core is not running on another thread, including from within a trap handler.
 type Trapper struct {
 	core   *Core
 	ptr    *C.struct_Trapper
 	handle cgo.Handle
-	traps  map[uint32]trap
+	sites  map[uint32]*trapSite
+
+	beforeHook func(addr uint32) bool
 }
 
 func NewTrapper(core *Core) *Trapper {
-	t := &Trapper{core: core, traps: map[uint32]trap{}}
+	t := &Trapper{core: core, sites: map[uint32]*trapSite{}}
 	t.ptr = (*C.struct_Trapper)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_Trapper{}))))
 	t.handle = cgo.NewHandle(t)
 	t.ptr.userData = unsafe.Pointer(&t.handle)
@@ -89,29 +169,133 @@ func NewTrapper(core *Core) *Trapper {
 	return t
 }
 
-func (t *Trapper) Add(addr uint32, handler func()) {
-	if _, ok := t.traps[addr]; ok {
-		panic(fmt.Sprintf("trap at 0x%08x already exists", addr))
+// Add traps a Thumb instruction with priority 0.
+func (t *Trapper) Add(addr uint32, handler func()) *Trap {
+	return t.AddWithPriority(addr, 0, handler)
+}
+
+// AddWithPriority traps a Thumb instruction. When several traps share an address, those with higher priority are called first.
+func (t *Trapper) AddWithPriority(addr uint32, priority int, handler func()) *Trap {
+	return t.add(addr, false, priority, handler)
+}
+
+// AddARM traps an ARM instruction. When several traps share an address, those with higher priority are called first.
+func (t *Trapper) AddARM(addr uint32, priority int, handler func()) *Trap {
+	return t.add(addr, true, priority, handler)
+}
+
+func (t *Trapper) add(addr uint32, arm bool, priority int, handler func()) *Trap {
+	site := t.sites[addr]
+	if site == nil {
+		site = &trapSite{arm: arm}
+		t.sites[addr] = site
+	}
+
+	if site.arm != arm {
+		panic(fmt.Sprintf("trap at 0x%08x is already trapped in the other instruction set", addr))
+	}
+
+	tr := &Trap{t: t, addr: addr, priority: priority, handler: handler, enabled: true}
+
+	i := len(site.traps)
+	for i > 0 && site.traps[i-1].priority < priority {
+		i--
+	}
+	site.traps = append(site.traps, nil)
+	copy(site.traps[i+1:], site.traps[i:])
+	site.traps[i] = tr
+
+	t.sync(addr)
+	return tr
+}
+
+// sync patches or unpatches an address, depending on whether any of its traps are enabled.
+func (t *Trapper) sync(addr uint32) {
+	site := t.sites[addr]
+
+	wantPatched := false
+	for _, tr := range site.traps {
+		if tr.enabled {
+			wantPatched = true
+			break
+		}
+	}
+
+	if wantPatched == site.patched {
+		return
+	}
+
+	if wantPatched {
+		if site.arm {
+			site.original = t.core.RawRead32(addr, -1)
+			t.core.RawWrite32(addr, -1, armBkptOpcode)
+		} else {
+			site.original = uint32(t.core.RawRead16(addr, -1))
+			t.core.RawWrite16(addr, -1, thumbBkptOpcode)
+		}
+	} else {
+		if site.arm {
+			t.core.RawWrite32(addr, -1, site.original)
+		} else {
+			t.core.RawWrite16(addr, -1, uint16(site.original))
+		}
 	}
-	tr := trap{t.core.RawRead16(addr, -1), handler}
-	t.core.RawWrite16(addr, -1, 0xbe00|C.TANGO_TRAPPER_IMM)
-	t.traps[addr] = tr
+	site.patched = wantPatched
+}
+
+// Original returns the instruction that a trap at addr replaced, or false if addr is not currently patched.
+func (t *Trapper) Original(addr uint32) (uint32, bool) {
+	site := t.sites[addr]
+	if site == nil || !site.patched {
+		return 0, false
+	}
+	return site.original, true
+}
+
+// SetBeforeHook sets a function that is called whenever a trapped instruction is reached, before it runs.
+//
+// If the hook returns true, neither the instruction nor its traps are run, and the PC is put back on the instruction, so the CPU stops just before it. The trap will be hit again next time the CPU runs unless it is disabled first.
+func (t *Trapper) SetBeforeHook(hook func(addr uint32) bool) {
+	t.beforeHook = hook
 }
 
 func (t *Trapper) Init(cpu unsafe.Pointer) {
 }
 
-func (t *Trapper) Handle() {
+// Handle calls the before hook, runs the original instruction, then calls every enabled trap at the address in priority order.
+func (t *Trapper) Handle(arm bool) {
 	const wordSizeThumb = 2
-	caller := t.core.GBA().Register(15) - wordSizeThumb*2
+	const wordSizeARM = 4
+
+	wordSize := uint32(wordSizeThumb)
+	if arm {
+		wordSize = wordSizeARM
+	}
+	caller := t.core.GBA().Register(15) - wordSize*2
 
-	trap := t.traps[caller]
-	if trap.handler == nil {
+	site := t.sites[caller]
+	if site == nil || !site.patched || site.arm != arm {
 		panic(fmt.Sprintf("unhandled trap at 0x%08x", caller))
 	}
 
-	t.core.GBA().ARMRunFake(trap.original)
-	trap.handler()
+	if t.beforeHook != nil && t.beforeHook(caller) {
+		t.core.GBA().SetRegister(15, caller)
+		if arm {
+			t.core.GBA().ARMWritePC()
+		} else {
+			t.core.GBA().ThumbWritePC()
+		}
+		return
+	}
+
+	t.core.GBA().ARMRunFake(site.original)
+
+	// Handlers may add or remove traps here, so work from a copy.
+	for _, tr := range append([]*Trap(nil), site.traps...) {
+		if tr.enabled {
+			tr.handler()
+		}
+	}
 }
 
 func (t *Trapper) Deinit() {
@@ -120,7 +304,8 @@ func (t *Trapper) Deinit() {
 func (t *Trapper) Attach(g *GBA) {
 	armCore := (*C.struct_ARMCore)(g.ptr.cpu)
 	t.ptr.realBkpt16 = armCore.irqh.bkpt16
+	t.ptr.realBkpt32 = armCore.irqh.bkpt32
 	(*[C.CPU_COMPONENT_MAX]*C.struct_mCPUComponent)(unsafe.Pointer(armCore.components))[C.CPU_COMPONENT_MISC_1] = (*C.struct_mCPUComponent)(unsafe.Pointer(t.ptr))
 	C.ARMHotplugAttach(armCore, C.CPU_COMPONENT_MISC_1)
-	C.tango_mgba_ARMInterruptHandler_setBkpt16_Trapper(&armCore.irqh)
+	C.tango_mgba_ARMInterruptHandler_setBkpts_Trapper(&armCore.irqh)
 }
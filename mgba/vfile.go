@@ -6,9 +6,24 @@ package mgba
 bool tango_mgba_util_VFile_close(struct VFile* vf) {
 	return vf->close(vf);
 }
+
+ssize_t tango_mgba_util_VFile_size(struct VFile* vf) {
+	return vf->size(vf);
+}
+
+bool tango_mgba_util_VFile_readAll(struct VFile* vf, void* buf, size_t size) {
+	off_t pos = vf->seek(vf, 0, SEEK_CUR);
+	if (vf->seek(vf, 0, SEEK_SET) < 0) {
+		return false;
+	}
+	ssize_t n = vf->read(vf, buf, size);
+	vf->seek(vf, pos, SEEK_SET);
+	return n == (ssize_t) size;
+}
 */
 import "C"
 import (
+	"errors"
 	"os"
 	"unsafe"
 )
@@ -51,6 +66,37 @@ func OpenVF(path string, flags int) *VFile {
 	return vf
 }
 
+// NewMemVF makes a VFile that lives entirely in memory, starting with a copy of b. It grows as it is written to, so it can be used for saves as well as ROMs.
+func NewMemVF(b []byte) *VFile {
+	var mem unsafe.Pointer
+	if len(b) > 0 {
+		mem = unsafe.Pointer(&b[0])
+	}
+	ptr := C.VFileMemChunk(mem, C.size_t(len(b)))
+	if ptr == nil {
+		return nil
+	}
+	return &VFile{ptr}
+}
+
+// Bytes returns a copy of the whole contents of the VFile, without moving its position.
+func (vf *VFile) Bytes() ([]byte, error) {
+	size := int(C.tango_mgba_util_VFile_size(vf.ptr))
+	if size < 0 {
+		return nil, errors.New("could not get vfile size")
+	}
+
+	buf := make([]byte, size)
+	if size == 0 {
+		return buf, nil
+	}
+
+	if !C.tango_mgba_util_VFile_readAll(vf.ptr, unsafe.Pointer(&buf[0]), C.size_t(size)) {
+		return nil, errors.New("could not read vfile")
+	}
+	return buf, nil
+}
+
 func (vf *VFile) Close() bool {
 	if vf.ptr == nil {
 		return true
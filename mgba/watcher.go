@@ -0,0 +1,318 @@
+package mgba
+
+/*
+#include <mgba/core/cpu.h>
+#include <mgba/internal/arm/arm.h>
+#include <mgba/internal/gba/gba.h>
+
+#define TANGO_WATCHER_MAX_RANGES 64
+
+#define TANGO_WATCH_READ 1
+#define TANGO_WATCH_WRITE 2
+
+struct tango_WatchRange {
+	uint32_t start;
+	uint32_t end;
+	int kind;
+};
+
+struct Watcher {
+	struct mCPUComponent cpuComponent;
+	struct ARMMemory realMemory;
+	struct tango_WatchRange ranges[TANGO_WATCHER_MAX_RANGES];
+	size_t nRanges;
+	void* userData;
+};
+
+extern void tango_Watcher_initCallback(void* cpu, struct mCPUComponent* component);
+extern void tango_Watcher_deinitCallback(struct mCPUComponent* component);
+extern void tango_Watcher_handle(struct Watcher* w, int kind, uint32_t address, int width, uint32_t oldValue, uint32_t newValue, uint32_t pc);
+
+static void tango_mCPUComponent_setCallbacks_Watcher(struct mCPUComponent* cpuComponent) {
+	cpuComponent->init = &tango_Watcher_initCallback;
+	cpuComponent->deinit = &tango_Watcher_deinitCallback;
+}
+
+static struct Watcher* tango_Watcher_get(struct ARMCore* cpu) {
+	return (struct Watcher*) cpu->components[CPU_COMPONENT_MISC_2];
+}
+
+static bool tango_Watcher_check(struct Watcher* w, uint32_t address, int width, int kind) {
+	for (size_t i = 0; i < w->nRanges; ++i) {
+		if ((w->ranges[i].kind & kind) && address < w->ranges[i].end && address + width > w->ranges[i].start) {
+			return true;
+		}
+	}
+	return false;
+}
+
+// By the time an instruction executes, the PC has already moved two instructions past it.
+static uint32_t tango_Watcher_pc(struct ARMCore* cpu) {
+	if (cpu->executionMode == MODE_THUMB) {
+		return cpu->gprs[ARM_PC] - WORD_SIZE_THUMB * 2;
+	}
+	return cpu->gprs[ARM_PC] - WORD_SIZE_ARM * 2;
+}
+
+#define TANGO_WATCHER_LOAD(WIDTH, BYTES) \
+	static uint32_t tango_Watcher_load ## WIDTH(struct ARMCore* cpu, uint32_t address, int* cycleCounter) { \
+		struct Watcher* w = tango_Watcher_get(cpu); \
+		uint32_t value = w->realMemory.load ## WIDTH(cpu, address, cycleCounter); \
+		if (tango_Watcher_check(w, address, BYTES, TANGO_WATCH_READ)) { \
+			tango_Watcher_handle(w, TANGO_WATCH_READ, address, BYTES, value, value, tango_Watcher_pc(cpu)); \
+		} \
+		return value; \
+	}
+
+#define TANGO_WATCHER_STORE(WIDTH, BYTES, TYPE) \
+	static void tango_Watcher_store ## WIDTH(struct ARMCore* cpu, uint32_t address, int ## WIDTH ## _t value, int* cycleCounter) { \
+		struct Watcher* w = tango_Watcher_get(cpu); \
+		if (!tango_Watcher_check(w, address, BYTES, TANGO_WATCH_WRITE)) { \
+			w->realMemory.store ## WIDTH(cpu, address, value, cycleCounter); \
+			return; \
+		} \
+		uint32_t oldValue = GBAView ## WIDTH(cpu, address); \
+		w->realMemory.store ## WIDTH(cpu, address, value, cycleCounter); \
+		tango_Watcher_handle(w, TANGO_WATCH_WRITE, address, BYTES, oldValue, (TYPE) value, tango_Watcher_pc(cpu)); \
+	}
+
+TANGO_WATCHER_LOAD(32, 4)
+TANGO_WATCHER_LOAD(16, 2)
+TANGO_WATCHER_LOAD(8, 1)
+
+TANGO_WATCHER_STORE(32, 4, uint32_t)
+TANGO_WATCHER_STORE(16, 2, uint16_t)
+TANGO_WATCHER_STORE(8, 1, uint8_t)
+
+// tango_Watcher_lsmStart returns the lowest address an ldm/stm touches. Registers are always transferred in ascending order from there.
+static uint32_t tango_Watcher_lsmStart(uint32_t baseAddress, int mask, enum LSMDirection direction) {
+	uint32_t n = __builtin_popcount(mask & 0xffff);
+	switch (direction) {
+	case LSM_IA:
+		return baseAddress;
+	case LSM_IB:
+		return baseAddress + 4;
+	case LSM_DA:
+		return baseAddress - 4 * (n - 1);
+	case LSM_DB:
+		return baseAddress - 4 * n;
+	}
+	return baseAddress;
+}
+
+static uint32_t tango_Watcher_loadMultiple(struct ARMCore* cpu, uint32_t baseAddress, int mask, enum LSMDirection direction, int* cycleCounter) {
+	struct Watcher* w = tango_Watcher_get(cpu);
+	uint32_t result = w->realMemory.loadMultiple(cpu, baseAddress, mask, direction, cycleCounter);
+
+	uint32_t n = __builtin_popcount(mask & 0xffff);
+	uint32_t start = tango_Watcher_lsmStart(baseAddress, mask, direction) & ~3;
+	for (uint32_t i = 0; i < n; ++i) {
+		uint32_t address = start + i * 4;
+		if (tango_Watcher_check(w, address, 4, TANGO_WATCH_READ)) {
+			uint32_t value = GBAView32(cpu, address);
+			tango_Watcher_handle(w, TANGO_WATCH_READ, address, 4, value, value, tango_Watcher_pc(cpu));
+		}
+	}
+	return result;
+}
+
+static uint32_t tango_Watcher_storeMultiple(struct ARMCore* cpu, uint32_t baseAddress, int mask, enum LSMDirection direction, int* cycleCounter) {
+	struct Watcher* w = tango_Watcher_get(cpu);
+
+	uint32_t n = __builtin_popcount(mask & 0xffff);
+	uint32_t start = tango_Watcher_lsmStart(baseAddress, mask, direction) & ~3;
+
+	uint32_t oldValues[16];
+	for (uint32_t i = 0; i < n; ++i) {
+		oldValues[i] = GBAView32(cpu, start + i * 4);
+	}
+
+	uint32_t result = w->realMemory.storeMultiple(cpu, baseAddress, mask, direction, cycleCounter);
+
+	for (uint32_t i = 0; i < n; ++i) {
+		uint32_t address = start + i * 4;
+		if (tango_Watcher_check(w, address, 4, TANGO_WATCH_WRITE)) {
+			tango_Watcher_handle(w, TANGO_WATCH_WRITE, address, 4, oldValues[i], GBAView32(cpu, address), tango_Watcher_pc(cpu));
+		}
+	}
+	return result;
+}
+
+static void tango_Watcher_install(struct Watcher* w, struct ARMCore* cpu) {
+	w->realMemory = cpu->memory;
+	cpu->memory.load32 = tango_Watcher_load32;
+	cpu->memory.load16 = tango_Watcher_load16;
+	cpu->memory.load8 = tango_Watcher_load8;
+	cpu->memory.store32 = tango_Watcher_store32;
+	cpu->memory.store16 = tango_Watcher_store16;
+	cpu->memory.store8 = tango_Watcher_store8;
+	cpu->memory.loadMultiple = tango_Watcher_loadMultiple;
+	cpu->memory.storeMultiple = tango_Watcher_storeMultiple;
+}
+
+// Only the access functions are put back: the rest of the memory struct, like the active region, has moved on since it was saved.
+static void tango_Watcher_uninstall(struct Watcher* w, struct ARMCore* cpu) {
+	cpu->memory.load32 = w->realMemory.load32;
+	cpu->memory.load16 = w->realMemory.load16;
+	cpu->memory.load8 = w->realMemory.load8;
+	cpu->memory.store32 = w->realMemory.store32;
+	cpu->memory.store16 = w->realMemory.store16;
+	cpu->memory.store8 = w->realMemory.store8;
+	cpu->memory.loadMultiple = w->realMemory.loadMultiple;
+	cpu->memory.storeMultiple = w->realMemory.storeMultiple;
+}
+*/
+import "C"
+import (
+	"fmt"
+	"runtime"
+	"runtime/cgo"
+	"unsafe"
+)
+
+//export tango_Watcher_initCallback
+func tango_Watcher_initCallback(cpu unsafe.Pointer, component *C.struct_mCPUComponent) {
+	handle := *(*cgo.Handle)((*C.struct_Watcher)(unsafe.Pointer(component)).userData)
+	w := handle.Value().(*Watcher)
+	w.Init(cpu)
+}
+
+//export tango_Watcher_deinitCallback
+func tango_Watcher_deinitCallback(component *C.struct_mCPUComponent) {
+	handle := *(*cgo.Handle)((*C.struct_Watcher)(unsafe.Pointer(component)).userData)
+	w := handle.Value().(*Watcher)
+	w.Deinit()
+}
+
+//export tango_Watcher_handle
+func tango_Watcher_handle(component *C.struct_Watcher, kind C.int, address C.uint32_t, width C.int, oldValue C.uint32_t, newValue C.uint32_t, pc C.uint32_t) {
+	handle := *(*cgo.Handle)(component.userData)
+	w := handle.Value().(*Watcher)
+	w.Handle(WatchEvent{
+		Kind:     WatchKind(kind),
+		Address:  uint32(address),
+		Width:    int(width),
+		OldValue: uint32(oldValue),
+		NewValue: uint32(newValue),
+		PC:       uint32(pc),
+	})
+}
+
+type WatchKind int
+
+const (
+	WatchRead      WatchKind = C.TANGO_WATCH_READ
+	WatchWrite     WatchKind = C.TANGO_WATCH_WRITE
+	WatchReadWrite WatchKind = WatchRead | WatchWrite
+)
+
+// WatchEvent describes a single access to watched memory.
+type WatchEvent struct {
+	Kind    WatchKind
+	Address uint32
+	// Width is the size of the access in bytes.
+	Width int
+	// OldValue is the value before a write. For reads, it is the same as NewValue.
+	OldValue uint32
+	// NewValue is the value written, or the value read.
+	NewValue uint32
+	// PC is the address of the instruction that made the access.
+	PC uint32
+}
+
+// Watchpoint is a single handler for accesses to a range of memory.
+type Watchpoint struct {
+	w       *Watcher
+	start   uint32
+	end     uint32
+	kind    WatchKind
+	handler func(WatchEvent)
+}
+
+// Remove removes the watchpoint.
+func (wp *Watchpoint) Remove() {
+	for i, other := range wp.w.watchpoints {
+		if other == wp {
+			wp.w.watchpoints = append(wp.w.watchpoints[:i:i], wp.w.watchpoints[i+1:]...)
+			break
+		}
+	}
+	wp.w.sync()
+}
+
+// Watcher calls Go functions when the CPU reads or writes given ranges of memory, by wrapping the CPU's memory access functions.
+//
+// Instruction fetches and DMA are not watched. Handlers are called right after the access, and must not run the core.
+//
+// Watchpoints may be added and removed at any time the core is not running on another thread, including from within a handler.
+type Watcher struct {
+	core        *Core
+	ptr         *C.struct_Watcher
+	handle      cgo.Handle
+	watchpoints []*Watchpoint
+}
+
+func NewWatcher(core *Core) *Watcher {
+	w := &Watcher{core: core}
+	w.ptr = (*C.struct_Watcher)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_Watcher{}))))
+	w.handle = cgo.NewHandle(w)
+	w.ptr.userData = unsafe.Pointer(&w.handle)
+	C.tango_mCPUComponent_setCallbacks_Watcher(&w.ptr.cpuComponent)
+	runtime.SetFinalizer(w, func(w *Watcher) {
+		w.handle.Delete()
+		C.free(unsafe.Pointer(w.ptr))
+	})
+	return w
+}
+
+// Add watches size bytes starting at addr.
+func (w *Watcher) Add(addr uint32, size int, kind WatchKind, handler func(WatchEvent)) *Watchpoint {
+	if len(w.watchpoints) >= C.TANGO_WATCHER_MAX_RANGES {
+		panic(fmt.Sprintf("too many watchpoints, at most %d are supported", C.TANGO_WATCHER_MAX_RANGES))
+	}
+
+	wp := &Watchpoint{w: w, start: addr, end: addr + uint32(size), kind: kind, handler: handler}
+	w.watchpoints = append(w.watchpoints, wp)
+	w.sync()
+	return wp
+}
+
+// sync copies the watched ranges to where the memory access functions can check them without calling into Go.
+func (w *Watcher) sync() {
+	for i, wp := range w.watchpoints {
+		w.ptr.ranges[i] = C.struct_tango_WatchRange{start: C.uint32_t(wp.start), end: C.uint32_t(wp.end), kind: C.int(wp.kind)}
+	}
+	w.ptr.nRanges = C.size_t(len(w.watchpoints))
+}
+
+// Handle calls every watchpoint that covers the access.
+func (w *Watcher) Handle(ev WatchEvent) {
+	// Handlers may add or remove watchpoints here, so work from a copy.
+	for _, wp := range append([]*Watchpoint(nil), w.watchpoints...) {
+		if wp.kind&ev.Kind == 0 || ev.Address >= wp.end || ev.Address+uint32(ev.Width) <= wp.start {
+			continue
+		}
+		wp.handler(ev)
+	}
+}
+
+func (w *Watcher) Init(cpu unsafe.Pointer) {
+}
+
+func (w *Watcher) Deinit() {
+}
+
+func (w *Watcher) Attach(g *GBA) {
+	armCore := (*C.struct_ARMCore)(g.ptr.cpu)
+	(*[C.CPU_COMPONENT_MAX]*C.struct_mCPUComponent)(unsafe.Pointer(armCore.components))[C.CPU_COMPONENT_MISC_2] = (*C.struct_mCPUComponent)(unsafe.Pointer(w.ptr))
+	C.ARMHotplugAttach(armCore, C.CPU_COMPONENT_MISC_2)
+	C.tango_Watcher_install(w.ptr, armCore)
+}
+
+// Detach puts the CPU's own memory access functions back and unregisters the watcher, so it can be attached to a core again or dropped. Its watchpoints are kept.
+func (w *Watcher) Detach(g *GBA) {
+	armCore := (*C.struct_ARMCore)(g.ptr.cpu)
+	C.tango_Watcher_uninstall(w.ptr, armCore)
+	C.ARMHotplugDetach(armCore, C.CPU_COMPONENT_MISC_2)
+	(*[C.CPU_COMPONENT_MAX]*C.struct_mCPUComponent)(unsafe.Pointer(armCore.components))[C.CPU_COMPONENT_MISC_2] = nil
+}
@@ -0,0 +1,169 @@
+package replay
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/murkland/tango/input"
+	"github.com/murkland/tango/mgba"
+)
+
+// writerQueueSize is how many writes can be waiting for the background goroutine before writes start blocking.
+const writerQueueSize = 1024
+
+var ErrWriterClosed = errors.New("replay writer closed")
+
+// Writer writes a replay file from a background goroutine, so slow disks don't hold up the caller.
+//
+// Write methods only queue the write: an error from an earlier write is returned by the next call, and Close returns the first error that happened.
+type Writer struct {
+	keyframeInterval int
+
+	ops  chan func(*syncWriter) error
+	done chan struct{}
+
+	// sendMu is held while sending to ops, so Close can't close it out from under a send.
+	sendMu sync.Mutex
+	closed bool
+
+	errMu sync.Mutex
+	err   error
+}
+
+// NewWriter creates a new replay file.
+//
+// If keyframeInterval is nonzero, the writer expects a keyframe every keyframeInterval ticks.
+func NewWriter(filename string, keyframeInterval int) (*Writer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	sw, err := newWriter(f, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	rw := &Writer{
+		keyframeInterval: keyframeInterval,
+		ops:              make(chan func(*syncWriter) error, writerQueueSize),
+		done:             make(chan struct{}),
+	}
+	go rw.run(sw)
+	return rw, nil
+}
+
+func (rw *Writer) run(sw *syncWriter) {
+	defer close(rw.done)
+
+	for op := range rw.ops {
+		if rw.Err() != nil {
+			// Once a write has failed, anything after it would just make a corrupt replay.
+			continue
+		}
+
+		if err := op(sw); err != nil {
+			rw.setErr(err)
+		}
+	}
+
+	if rw.Err() != nil {
+		// Flushing and indexing after a failed write would only add to a corrupt replay, so just close the file.
+		sw.Abort()
+		return
+	}
+
+	if err := sw.Close(); err != nil {
+		rw.setErr(err)
+	}
+}
+
+func (rw *Writer) setErr(err error) {
+	rw.errMu.Lock()
+	defer rw.errMu.Unlock()
+	if rw.err == nil {
+		rw.err = err
+	}
+}
+
+// Err returns the first error that happened while writing, if any.
+func (rw *Writer) Err() error {
+	rw.errMu.Lock()
+	defer rw.errMu.Unlock()
+	return rw.err
+}
+
+func (rw *Writer) enqueue(op func(*syncWriter) error) error {
+	rw.sendMu.Lock()
+	defer rw.sendMu.Unlock()
+
+	if rw.closed {
+		return ErrWriterClosed
+	}
+
+	if err := rw.Err(); err != nil {
+		return err
+	}
+
+	rw.ops <- op
+	return nil
+}
+
+func (rw *Writer) KeyframeInterval() int {
+	return rw.keyframeInterval
+}
+
+func (rw *Writer) WriteMetadata(metadata Metadata) error {
+	return rw.enqueue(func(sw *syncWriter) error {
+		return sw.WriteMetadata(metadata)
+	})
+}
+
+func (rw *Writer) WriteState(playerIndex int, state *mgba.State) error {
+	return rw.enqueue(func(sw *syncWriter) error {
+		return sw.WriteState(playerIndex, state)
+	})
+}
+
+func (rw *Writer) WriteInit(playerIndex int, marshaled []byte) error {
+	return rw.enqueue(func(sw *syncWriter) error {
+		return sw.WriteInit(playerIndex, marshaled)
+	})
+}
+
+// WriteKeyframe writes the state at the start of the given tick, before any of its inputs are applied.
+func (rw *Writer) WriteKeyframe(tick int, state *mgba.State) error {
+	return rw.enqueue(func(sw *syncWriter) error {
+		return sw.WriteKeyframe(tick, state)
+	})
+}
+
+func (rw *Writer) Write(rngState uint32, inputPair [2]input.Input) error {
+	return rw.enqueue(func(sw *syncWriter) error {
+		return sw.Write(rngState, inputPair)
+	})
+}
+
+func (rw *Writer) WriteResult(result Result) error {
+	return rw.enqueue(func(sw *syncWriter) error {
+		return sw.WriteResult(result)
+	})
+}
+
+// Close waits for all queued writes to finish, then closes the file. It returns the first error that happened while writing, if any.
+func (rw *Writer) Close() error {
+	rw.sendMu.Lock()
+	if rw.closed {
+		rw.sendMu.Unlock()
+		return ErrWriterClosed
+	}
+	rw.closed = true
+	close(rw.ops)
+	rw.sendMu.Unlock()
+
+	<-rw.done
+
+	return rw.Err()
+}
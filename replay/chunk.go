@@ -0,0 +1,173 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	chunkTypeData  uint8 = 0
+	chunkTypeIndex uint8 = 1
+)
+
+type chunkHeader struct {
+	Type  uint8
+	Size  uint32
+	CRC32 uint32
+}
+
+// chunkHeaderFieldsSize is the size of the fields of chunkHeader.
+const chunkHeaderFieldsSize = 1 + 4 + 4
+
+// chunkHeaderSize is the size of a chunk header: the fields of chunkHeader, followed by a crc32 of them.
+const chunkHeaderSize = chunkHeaderFieldsSize + 4
+
+// maxChunkSize is the largest payload a chunk may have. Anything bigger can only be a corrupt size, so it is rejected before anything is allocated for it.
+const maxChunkSize = 64 * 1024 * 1024
+
+// ErrCorruptChunk is returned when a chunk's checksum doesn't match its contents.
+var ErrCorruptChunk = errors.New("corrupt chunk")
+
+type corruptChunkError struct {
+	offset int64
+	what   string
+}
+
+func (e *corruptChunkError) Error() string {
+	return fmt.Sprintf("chunk at offset %d is corrupt: %s", e.offset, e.what)
+}
+
+func (e *corruptChunkError) Unwrap() error {
+	return ErrCorruptChunk
+}
+
+func writeChunk(w io.Writer, chunkType uint8, payload []byte) error {
+	if len(payload) > maxChunkSize {
+		return fmt.Errorf("chunk too big: %d > %d", len(payload), maxChunkSize)
+	}
+
+	var header bytes.Buffer
+	if err := binary.Write(&header, binary.LittleEndian, chunkHeader{chunkType, uint32(len(payload)), crc32.ChecksumIEEE(payload)}); err != nil {
+		return err
+	}
+	if err := binary.Write(&header, binary.LittleEndian, crc32.ChecksumIEEE(header.Bytes())); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readChunkHeader reads a chunk's header and checks it, so its size can be trusted.
+func readChunkHeader(r io.Reader, offset int64) (chunkHeader, error) {
+	var header chunkHeader
+
+	var rawHeader [chunkHeaderSize]byte
+	if _, err := io.ReadFull(r, rawHeader[:]); err != nil {
+		return header, err
+	}
+
+	if err := binary.Read(bytes.NewReader(rawHeader[:]), binary.LittleEndian, &header); err != nil {
+		return header, err
+	}
+
+	// The header is checked before its size is trusted, so a corrupt size can't be mistaken for a cut off chunk.
+	expected := binary.LittleEndian.Uint32(rawHeader[chunkHeaderFieldsSize:])
+	if actual := crc32.ChecksumIEEE(rawHeader[:chunkHeaderFieldsSize]); actual != expected {
+		return header, &corruptChunkError{offset, fmt.Sprintf("header crc32 %08x != %08x", actual, expected)}
+	}
+
+	if header.Size > maxChunkSize {
+		return header, &corruptChunkError{offset, fmt.Sprintf("size too big: %d > %d", header.Size, maxChunkSize)}
+	}
+
+	return header, nil
+}
+
+// readChunk reads a single chunk and checks it.
+//
+// A chunk cut off by the end of the file is reported as io.ErrUnexpectedEOF, and a clean end of file before the chunk as io.EOF.
+func readChunk(r io.Reader, offset int64) (chunkHeader, []byte, error) {
+	header, err := readChunkHeader(r, offset)
+	if err != nil {
+		return header, nil, err
+	}
+
+	payload := make([]byte, int(header.Size))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return header, nil, err
+	}
+
+	if actual := crc32.ChecksumIEEE(payload); actual != header.CRC32 {
+		return header, nil, &corruptChunkError{offset, fmt.Sprintf("crc32 %08x != %08x", actual, header.CRC32)}
+	}
+
+	return header, payload, nil
+}
+
+// chunkReader presents the decompressed contents of all the data chunks as one stream.
+type chunkReader struct {
+	r      io.Reader
+	dec    *zstd.Decoder
+	offset int64
+	buf    []byte
+	err    error
+}
+
+func newChunkReader(r io.Reader, dec *zstd.Decoder, offset int64) *chunkReader {
+	return &chunkReader{r: r, dec: dec, offset: offset}
+}
+
+func (cr *chunkReader) nextChunk() error {
+	offset := cr.offset
+	header, payload, err := readChunk(cr.r, offset)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The last chunk was only partially written, e.g. because the client crashed. Everything before it is still good.
+			return io.EOF
+		}
+		return err
+	}
+	cr.offset += chunkHeaderSize + int64(header.Size)
+
+	if header.Type == chunkTypeIndex {
+		return io.EOF
+	}
+
+	if header.Type != chunkTypeData {
+		return fmt.Errorf("unknown chunk type at offset %d: %02x", offset, header.Type)
+	}
+
+	cr.buf, err = cr.dec.DecodeAll(payload, cr.buf[:0])
+	if err != nil {
+		return fmt.Errorf("chunk at offset %d failed to decompress: %w", offset, err)
+	}
+	return nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.err = cr.nextChunk()
+	}
+
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,381 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const libraryIndexFilename = "index.json"
+const libraryIndexVersion = 1
+
+type LibraryEntry struct {
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+
+	ROMTitle         string    `json:"rom_title"`
+	ROMCRC32         uint32    `json:"rom_crc32"`
+	Date             time.Time `json:"date"`
+	LocalPlayerIndex int       `json:"local_player_index"`
+	Ticks            int       `json:"ticks"`
+	Result           Result    `json:"result"`
+	SessionID        string    `json:"session_id,omitempty"`
+	// Battles is how many battles a match file holds, or 0 for a single battle replay.
+	Battles int `json:"battles,omitempty"`
+}
+
+func (e LibraryEntry) Duration() time.Duration {
+	return time.Duration(e.Ticks) * time.Second / 60
+}
+
+type libraryIndex struct {
+	Version int            `json:"version"`
+	Entries []LibraryEntry `json:"entries"`
+}
+
+type Library struct {
+	dir     string
+	entries []LibraryEntry
+}
+
+// summarize reads through a replay to find its metadata, local player index and how many ticks it has.
+func summarize(r io.Reader) (Metadata, int, int, error) {
+	rr, err := NewReader(r)
+	if err != nil {
+		return Metadata{}, 0, 0, err
+	}
+	defer rr.Close()
+
+	ticks := 0
+	for {
+		if _, err := rr.Next(); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return Metadata{}, 0, 0, err
+		}
+		ticks++
+	}
+
+	return rr.Header(), rr.LocalPlayerIndex(), ticks, nil
+}
+
+func indexReplay(path string, info fs.FileInfo) (LibraryEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return LibraryEntry{}, err
+	}
+	defer f.Close()
+
+	metadata, localPlayerIndex, ticks, err := summarize(f)
+	if err != nil {
+		return LibraryEntry{}, err
+	}
+
+	date := metadata.StartTime
+	if date.IsZero() {
+		// Replays from before the metadata header don't know when they were recorded, so the best we have is when the file was last written to.
+		date = info.ModTime()
+	}
+
+	return LibraryEntry{
+		Filename: info.Name(),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+
+		ROMTitle:         metadata.ROMTitle,
+		ROMCRC32:         metadata.ROMCRC32,
+		Date:             date,
+		LocalPlayerIndex: localPlayerIndex,
+		Ticks:            ticks,
+		Result:           metadata.Result,
+		SessionID:        metadata.SessionID,
+	}, nil
+}
+
+// CollectReplays expands paths into a list of replay files. Files are kept as they are, and directories are replaced by the replays directly inside them.
+func CollectReplays(paths []string) ([]string, error) {
+	var replays []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			replays = append(replays, path)
+			continue
+		}
+
+		dirents, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dirent := range dirents {
+			if dirent.IsDir() || filepath.Ext(dirent.Name()) != ".tangoreplay" {
+				continue
+			}
+			replays = append(replays, filepath.Join(path, dirent.Name()))
+		}
+	}
+	return replays, nil
+}
+
+func LibraryIndexPath(dir string) string {
+	return filepath.Join(dir, libraryIndexFilename)
+}
+
+// indexMatch indexes a whole match as one entry: it lasts as long as all its battles put together, and its result is whoever won more of them.
+func indexMatch(path string, info fs.FileInfo) (LibraryEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return LibraryEntry{}, err
+	}
+	defer f.Close()
+
+	m, err := OpenMatch(f, info.Size())
+	if err != nil {
+		return LibraryEntry{}, err
+	}
+	if len(m.Battles) == 0 {
+		return LibraryEntry{}, errors.New("match has no battles")
+	}
+
+	var first Metadata
+	firstLocalPlayerIndex := 0
+	ticks := 0
+	wins := 0
+	losses := 0
+	for i, battle := range m.Battles {
+		metadata, localPlayerIndex, battleTicks, err := summarize(battle)
+		if err != nil {
+			return LibraryEntry{}, fmt.Errorf("battle %d: %w", i, err)
+		}
+		if i == 0 {
+			first = metadata
+			firstLocalPlayerIndex = localPlayerIndex
+		}
+
+		ticks += battleTicks
+		switch metadata.Result {
+		case ResultWin:
+			wins++
+		case ResultLoss:
+			losses++
+		}
+	}
+
+	date := first.StartTime
+	if date.IsZero() {
+		date = info.ModTime()
+	}
+
+	result := ResultUnknown
+	if wins > losses {
+		result = ResultWin
+	} else if losses > wins {
+		result = ResultLoss
+	}
+
+	return LibraryEntry{
+		Filename: info.Name(),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+
+		ROMTitle:         first.ROMTitle,
+		ROMCRC32:         first.ROMCRC32,
+		Date:             date,
+		LocalPlayerIndex: firstLocalPlayerIndex,
+		Ticks:            ticks,
+		Result:           result,
+		SessionID:        first.SessionID,
+		Battles:          len(m.Battles),
+	}, nil
+}
+
+// OpenLibrary indexes all the replays and matches in a directory.
+//
+// The index is cached in the directory itself, so only replays that were added or changed since the last time need to be read.
+func OpenLibrary(dir string) (*Library, error) {
+	indexPath := LibraryIndexPath(dir)
+
+	cached := map[string]LibraryEntry{}
+	if raw, err := os.ReadFile(indexPath); err == nil {
+		var index libraryIndex
+		if err := json.Unmarshal(raw, &index); err != nil {
+			log.Printf("replay library index is corrupt, rebuilding: %s", err)
+		} else if index.Version == libraryIndexVersion {
+			for _, entry := range index.Entries {
+				cached[entry.Filename] = entry
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Library{dir: dir}
+	dirty := len(cached) == 0
+	for _, dirent := range dirents {
+		ext := filepath.Ext(dirent.Name())
+		if dirent.IsDir() || (ext != ".tangoreplay" && ext != ".tangomatch") {
+			continue
+		}
+
+		info, err := dirent.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		if entry, ok := cached[dirent.Name()]; ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			l.entries = append(l.entries, entry)
+			delete(cached, dirent.Name())
+			continue
+		}
+
+		index := indexReplay
+		if ext == ".tangomatch" {
+			index = indexMatch
+		}
+		entry, err := index(filepath.Join(dir, dirent.Name()), info)
+		if err != nil {
+			log.Printf("failed to index replay %s: %s", dirent.Name(), err)
+			continue
+		}
+		l.entries = append(l.entries, entry)
+		dirty = true
+	}
+
+	// Anything left in the cache no longer exists.
+	if len(cached) > 0 {
+		dirty = true
+	}
+
+	if dirty {
+		if err := l.saveIndex(); err != nil {
+			log.Printf("failed to save replay library index: %s", err)
+		}
+	}
+
+	return l, nil
+}
+
+func (l *Library) saveIndex() error {
+	raw, err := json.Marshal(libraryIndex{Version: libraryIndexVersion, Entries: l.entries})
+	if err != nil {
+		return err
+	}
+
+	indexPath := LibraryIndexPath(l.dir)
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, indexPath)
+}
+
+func (l *Library) Dir() string {
+	return l.dir
+}
+
+func (l *Library) Path(entry LibraryEntry) string {
+	return filepath.Join(l.dir, entry.Filename)
+}
+
+type LibrarySortKey int
+
+const (
+	LibrarySortKeyDate LibrarySortKey = iota
+	LibrarySortKeyLength
+	LibrarySortKeyROM
+)
+
+func (k *LibrarySortKey) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "date":
+		*k = LibrarySortKeyDate
+	case "length":
+		*k = LibrarySortKeyLength
+	case "rom":
+		*k = LibrarySortKeyROM
+	default:
+		return fmt.Errorf("unknown sort key: %s", string(text))
+	}
+	return nil
+}
+
+type LibraryQuery struct {
+	// ROMTitle matches entries whose ROM title contains it, case-insensitively.
+	ROMTitle string
+	// Result matches entries with exactly this result, if set.
+	Result *Result
+	// Since and Until bound the date of the entries, if set.
+	Since time.Time
+	Until time.Time
+
+	SortKey   LibrarySortKey
+	Ascending bool
+}
+
+func (q LibraryQuery) matches(entry LibraryEntry) bool {
+	if q.ROMTitle != "" && !strings.Contains(strings.ToLower(entry.ROMTitle), strings.ToLower(q.ROMTitle)) {
+		return false
+	}
+	if q.Result != nil && entry.Result != *q.Result {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Date.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !entry.Date.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Query returns all entries matching the query, sorted. Ties are always broken by date.
+func (l *Library) Query(q LibraryQuery) []LibraryEntry {
+	var entries []LibraryEntry
+	for _, entry := range l.entries {
+		if q.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	less := func(a LibraryEntry, b LibraryEntry) bool {
+		switch q.SortKey {
+		case LibrarySortKeyLength:
+			if a.Ticks != b.Ticks {
+				return a.Ticks < b.Ticks
+			}
+		case LibrarySortKeyROM:
+			if a.ROMTitle != b.ROMTitle {
+				return a.ROMTitle < b.ROMTitle
+			}
+		}
+		return a.Date.Before(b.Date)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if q.Ascending {
+			return less(entries[i], entries[j])
+		}
+		return less(entries[j], entries[i])
+	})
+
+	return entries
+}
@@ -0,0 +1,214 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+const matchVersion = 0x01
+const matchHeader = "TMAT"
+
+const (
+	chunkTypeMatchHeader uint8 = 2
+	chunkTypeBattle      uint8 = 3
+)
+
+// Match is every battle of a match, along with what both sides agreed on before the first one.
+type Match struct {
+	// Seed is the negotiated RNG seed.
+	Seed []byte
+
+	// Hellos are the marshaled Hello packets, ours first.
+	Hellos [2][]byte
+
+	// Battles read each battle's replay file, in order.
+	Battles []*io.SectionReader
+}
+
+// MatchWriter writes a match file, which finished battle replays are appended to one at a time.
+//
+// Marshaled match format is:
+//
+// header (uncompressed):
+// u8[4]: TMAT
+// u8: match version
+//
+// chunks, in the same format as replay chunks:
+//
+// match header chunk (type 0x02), always first:
+// u8: seed size
+// seed size: seed
+// u16: our hello size
+// our hello size: our hello
+// u16: their hello size
+// their hello size: their hello
+//
+// battle chunk (type 0x03), one per battle in order:
+// payload size: the battle's replay file
+type MatchWriter struct {
+	f *os.File
+}
+
+func NewMatchWriter(filename string, seed []byte, hellos [2][]byte) (*MatchWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	mw := &MatchWriter{f: f}
+	if err := mw.writeHeader(seed, hellos); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return mw, nil
+}
+
+func (mw *MatchWriter) writeHeader(seed []byte, hellos [2][]byte) error {
+	if _, err := mw.f.Write([]byte(matchHeader)); err != nil {
+		return err
+	}
+
+	if err := binary.Write(mw.f, binary.LittleEndian, uint8(matchVersion)); err != nil {
+		return err
+	}
+
+	var payload bytes.Buffer
+
+	if err := binary.Write(&payload, binary.LittleEndian, uint8(len(seed))); err != nil {
+		return err
+	}
+	if _, err := payload.Write(seed); err != nil {
+		return err
+	}
+
+	for _, hello := range hellos {
+		if err := binary.Write(&payload, binary.LittleEndian, uint16(len(hello))); err != nil {
+			return err
+		}
+		if _, err := payload.Write(hello); err != nil {
+			return err
+		}
+	}
+
+	return writeChunk(mw.f, chunkTypeMatchHeader, payload.Bytes())
+}
+
+// AppendBattle copies a finished battle's replay file into the match.
+func (mw *MatchWriter) AppendBattle(replayPath string) error {
+	raw, err := os.ReadFile(replayPath)
+	if err != nil {
+		return err
+	}
+
+	return writeChunk(mw.f, chunkTypeBattle, raw)
+}
+
+func (mw *MatchWriter) Close() error {
+	return mw.f.Close()
+}
+
+// OpenMatch reads a match's header and finds each of its battles, without reading the battles themselves. If the match file was cut off partway through a battle, the battles before it are still returned.
+func OpenMatch(r io.ReaderAt, size int64) (*Match, error) {
+	sr := io.NewSectionReader(r, 0, size)
+
+	var header [4]byte
+	if _, err := io.ReadFull(sr, header[:]); err != nil {
+		return nil, err
+	}
+
+	if string(header[:]) != matchHeader {
+		return nil, fmt.Errorf("invalid format")
+	}
+
+	var version uint8
+	if err := binary.Read(sr, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+
+	if version != matchVersion {
+		return nil, fmt.Errorf("unsupported match version: %02x vs %02x", version, matchVersion)
+	}
+
+	offset := int64(len(matchHeader) + 1)
+
+	chunk, payload, err := readChunk(sr, offset)
+	if err != nil {
+		return nil, err
+	}
+	offset += chunkHeaderSize + int64(chunk.Size)
+
+	if chunk.Type != chunkTypeMatchHeader {
+		return nil, fmt.Errorf("expected match header chunk, got %02x", chunk.Type)
+	}
+
+	m, err := readMatchHeader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		// Battles are replay files with their own checksummed chunks, so only the headers of the battle chunks are read here.
+		chunk, err := readChunkHeader(sr, offset)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("match was truncated")
+				break
+			}
+			return nil, err
+		}
+
+		if chunk.Type != chunkTypeBattle {
+			return nil, fmt.Errorf("unknown chunk type at offset %d: %02x", offset, chunk.Type)
+		}
+
+		payloadOffset := offset + chunkHeaderSize
+		if payloadOffset+int64(chunk.Size) > size {
+			log.Printf("match was truncated")
+			break
+		}
+		m.Battles = append(m.Battles, io.NewSectionReader(r, payloadOffset, int64(chunk.Size)))
+
+		offset = payloadOffset + int64(chunk.Size)
+		if _, err := sr.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func readMatchHeader(r io.Reader) (*Match, error) {
+	m := &Match{}
+
+	var seedSize uint8
+	if err := binary.Read(r, binary.LittleEndian, &seedSize); err != nil {
+		return nil, err
+	}
+
+	m.Seed = make([]byte, int(seedSize))
+	if _, err := io.ReadFull(r, m.Seed); err != nil {
+		return nil, err
+	}
+
+	for i := range m.Hellos {
+		var helloSize uint16
+		if err := binary.Read(r, binary.LittleEndian, &helloSize); err != nil {
+			return nil, err
+		}
+
+		m.Hellos[i] = make([]byte, int(helloSize))
+		if _, err := io.ReadFull(r, m.Hellos[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,330 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/murkland/tango/input"
+	"github.com/murkland/tango/mgba"
+)
+
+// Tick is a single committed tick from a replay.
+type Tick struct {
+	InputPair [2]input.Input
+	RNGState  uint32
+
+	// Keyframe is the state at the start of this tick, if the replay has one for it.
+	Keyframe *Keyframe
+}
+
+// legacyVersion is the version of replays from before the chunked format. They are a single zstd stream with no metadata, keyframes or record types, and can still be read so they can be upgraded.
+const legacyVersion = 0x08
+
+// Reader reads a replay one tick at a time, so the whole battle never needs to be in memory at once.
+type Reader struct {
+	// rs is the underlying replay, if it can be seeked.
+	rs io.ReadSeeker
+	br *bufio.Reader
+
+	r       io.Reader
+	dec     *zstd.Decoder
+	version uint8
+	legacy  bool
+
+	metadata         Metadata
+	init             [2][]byte
+	localPlayerIndex int
+	state            *mgba.State
+
+	done bool
+}
+
+// NewReader reads a replay up to the first tick.
+//
+// Marshaled replay format is:
+//
+// header (uncompressed):
+// u8[4]: TOOT
+// u8: replay version
+//
+// chunks:
+// u8: chunk type (0x00 = data, 0x01 = index)
+// u32: payload size
+// u32: crc32 of payload
+// u32: crc32 of the chunk type, payload size and payload crc32
+// payload size: payload, a zstd frame for data chunks
+//
+// The decompressed data chunks together make up the rest of the replay, and the index chunk is always last.
+//
+// metadata:
+// u32: metadata size
+// metadata size: metadata as JSON
+//
+// init (two of them):
+// u8: player index
+// init size: init
+//
+// state:
+// u8: local player index
+// u32: state size
+// state size: state
+//
+// records:
+// u8: record type
+//
+// input record (type 0x00):
+// u32: tick
+// u32: remote tick
+// u32: rng2state
+// u16: p1joyflags
+// u8: p1customstate
+// u16: p2joyflags
+// u8: p2customstate
+// u8: turn flags (0b00 = nobody, 0b01 = p1, 0b10 = p2, 0b11 = p1 and p2)
+// turn size: turn data
+//
+// result record (type 0x01), always the last record:
+// u8: result
+//
+// keyframe record (type 0x02), always at the start of a new chunk:
+// u32: tick
+// u32: state size
+// state size: state
+//
+// index chunk:
+// index entry (one per keyframe):
+// u32: tick
+// u64: offset of the keyframe's chunk from the start of the file
+//
+// index footer:
+// u32: number of index entries
+// u8[4]: TIDX
+//
+// Version 0x08 replays are instead a single zstd stream of the header, inits, state and input records without record types.
+func NewReader(r io.Reader) (*Reader, error) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &Reader{dec: dec, br: bufio.NewReader(r)}
+	rr.rs, _ = r.(io.ReadSeeker)
+	if err := rr.readPreamble(rr.br); err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return rr, nil
+}
+
+func (rr *Reader) readPreamble(br *bufio.Reader) error {
+	// Chunked replays start with an uncompressed header, legacy ones are zstd all the way through.
+	magic, err := br.Peek(len(replayHeader))
+	if err != nil {
+		return err
+	}
+	legacy := string(magic) != replayHeader
+
+	headerReader := io.Reader(br)
+	if legacy {
+		if err := rr.dec.Reset(br); err != nil {
+			return err
+		}
+		headerReader = rr.dec
+	}
+
+	// read header
+	var header [4]byte
+	if _, err := io.ReadFull(headerReader, header[:]); err != nil {
+		return err
+	}
+
+	if string(header[:]) != replayHeader {
+		return fmt.Errorf("invalid format")
+	}
+
+	if err := binary.Read(headerReader, binary.LittleEndian, &rr.version); err != nil {
+		return err
+	}
+	if (legacy && rr.version != legacyVersion) || (!legacy && rr.version != replayVersion) {
+		return fmt.Errorf("unsupported replay version: %02x vs %02x", rr.version, replayVersion)
+	}
+	rr.legacy = legacy
+
+	rr.r = headerReader
+	if !legacy {
+		rr.r = newChunkReader(br, rr.dec, int64(len(replayHeader)+1))
+	}
+	zr := rr.r
+
+	// read metadata
+	if !rr.legacy {
+		metadata, err := readMetadata(zr)
+		if err != nil {
+			return err
+		}
+		rr.metadata = metadata
+	}
+
+	// read inits
+	for i := 0; i < 2; i++ {
+		var playerIndex uint8
+		if err := binary.Read(zr, binary.LittleEndian, &playerIndex); err != nil {
+			return err
+		}
+
+		var marshaled [0x100]byte
+		if _, err := io.ReadFull(zr, marshaled[:]); err != nil {
+			return err
+		}
+
+		rr.init[playerIndex] = marshaled[:]
+	}
+
+	// read state
+	var localPlayerIndex uint8
+	if err := binary.Read(zr, binary.LittleEndian, &localPlayerIndex); err != nil {
+		return err
+	}
+	rr.localPlayerIndex = int(localPlayerIndex)
+
+	var stateSize uint32
+	if err := binary.Read(zr, binary.LittleEndian, &stateSize); err != nil {
+		return err
+	}
+
+	stateBytes := make([]byte, int(stateSize))
+	if _, err := io.ReadFull(zr, stateBytes); err != nil {
+		return err
+	}
+	rr.state = mgba.StateFromBytes(stateBytes)
+
+	if rr.legacy {
+		// Legacy replays don't have a header, so take what we can from the state.
+		rr.metadata.ROMTitle = rr.state.ROMTitle
+		rr.metadata.ROMCRC32 = rr.state.ROMCRC32
+	}
+
+	return nil
+}
+
+// SeekKeyframe moves to a keyframe from the replay's index, so the next tick returned is the one the keyframe is for. The replay must have been opened from an io.ReadSeeker.
+func (rr *Reader) SeekKeyframe(entry IndexEntry) error {
+	if rr.rs == nil || rr.legacy {
+		return errors.New("replay can't be seeked")
+	}
+
+	if _, err := rr.rs.Seek(entry.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	rr.br.Reset(rr.rs)
+	rr.r = newChunkReader(rr.br, rr.dec, entry.Offset)
+	rr.done = false
+	return nil
+}
+
+// Version returns the version of the replay format the replay was written in.
+func (rr *Reader) Version() uint8 {
+	return rr.version
+}
+
+// Header returns the replay's metadata. The result is only filled in once Next has returned io.EOF.
+func (rr *Reader) Header() Metadata {
+	return rr.metadata
+}
+
+func (rr *Reader) Inits() [2][]byte {
+	return rr.init
+}
+
+func (rr *Reader) LocalPlayerIndex() int {
+	return rr.localPlayerIndex
+}
+
+func (rr *Reader) State() *mgba.State {
+	return rr.state
+}
+
+// Next returns the next tick. It returns io.EOF once there are no more ticks, including if the replay was truncated.
+func (rr *Reader) Next() (Tick, error) {
+	if rr.done {
+		return Tick{}, io.EOF
+	}
+
+	tick, err := rr.next()
+	if err != nil {
+		rr.done = true
+	}
+	return tick, err
+}
+
+func (rr *Reader) next() (Tick, error) {
+	zr := rr.r
+
+	var tick Tick
+	for {
+		recordType := recordTypeInput
+		if !rr.legacy {
+			if err := binary.Read(zr, binary.LittleEndian, &recordType); err != nil {
+				if errors.Is(err, io.EOF) {
+					log.Printf("replay was truncated")
+				}
+				return Tick{}, err
+			}
+		}
+
+		if recordType == recordTypeResult {
+			if err := binary.Read(zr, binary.LittleEndian, &rr.metadata.Result); err != nil {
+				if errors.Is(err, io.EOF) {
+					log.Printf("replay was truncated")
+					return Tick{}, io.EOF
+				}
+				return Tick{}, err
+			}
+			return Tick{}, io.EOF
+		}
+
+		if recordType == recordTypeKeyframe {
+			keyframe, err := readKeyframe(zr)
+			if err != nil {
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					log.Printf("replay was truncated")
+					return Tick{}, io.EOF
+				}
+				return Tick{}, err
+			}
+			tick.Keyframe = &keyframe
+			continue
+		}
+
+		if recordType != recordTypeInput {
+			return Tick{}, fmt.Errorf("unknown record type: %02x", recordType)
+		}
+
+		// the rng state isn't needed for playback, but tools/replayverify checks it.
+		inputPair, rngState, err := readInputPair(zr)
+		if err != nil {
+			// Without a result record, the end of the file is the only way to tell the replay is over.
+			if errors.Is(err, io.EOF) && rr.legacy {
+				return Tick{}, io.EOF
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("replay was truncated")
+				return Tick{}, io.EOF
+			}
+			return Tick{}, err
+		}
+
+		tick.InputPair = inputPair
+		tick.RNGState = rngState
+		return tick, nil
+	}
+}
+
+func (rr *Reader) Close() {
+	rr.dec.Close()
+}
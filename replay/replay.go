@@ -1,232 +1,379 @@
 package replay
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/murkland/tango/input"
 	"github.com/murkland/tango/mgba"
 )
 
+type Result uint8
+
+// Results are from the perspective of the local player.
+const (
+	ResultUnknown Result = 0
+	ResultWin     Result = 1
+	ResultLoss    Result = 2
+)
+
+func (r Result) String() string {
+	switch r {
+	case ResultWin:
+		return "win"
+	case ResultLoss:
+		return "loss"
+	default:
+		return "unknown"
+	}
+}
+
+func (r Result) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Result) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "win":
+		*r = ResultWin
+	case "loss":
+		*r = ResultLoss
+	case "unknown":
+		*r = ResultUnknown
+	default:
+		return fmt.Errorf("unknown result: %s", string(text))
+	}
+	return nil
+}
+
+type Metadata struct {
+	TangoVersion string    `json:"tango_version"`
+	ROMTitle     string    `json:"rom_title"`
+	ROMCRC32     uint32    `json:"rom_crc32"`
+	MatchType    uint16    `json:"match_type"`
+	BattleNumber int       `json:"battle_number"`
+	InputDelays  [2]int    `json:"input_delays"`
+	StartTime    time.Time `json:"start_time"`
+	SessionID    string    `json:"session_id"`
+
+	// Result is not part of the header: it is only known once the battle is over, so it is written at the end of the replay instead.
+	Result Result `json:"-"`
+}
+
 type Replay struct {
+	Metadata         Metadata
 	State            *mgba.State
 	LocalPlayerIndex int
 	Init             [2][]byte
 	InputPairs       [][2]input.Input
 	RNGStates        []uint32
+	Keyframes        []Keyframe
 }
 
-// Marshaled replay format is:
-//
-// header:
-// u8[4]: TOOT
-// u8: replay version
-// u8: local player index
-//
-// init (two of them):
-// u8: player index
-// init size: init
-//
-// state:
-// u32: state size
-// state size: state
-//
-// inputs:
-// u32: tick
-// u32: rng2state
-// u16: p1joyflags
-// u8: p1customstate
-// u16: p2joyflags
-// u8: p2customstate
-// u8: turn flags (0b00 = nobody, 0b01 = p1, 0b10 = p2, 0b11 = p1 and p2)
-// turn size: turn data
-func Unmarshal(r io.Reader) (*Replay, error) {
-	zr, err := zstd.NewReader(r)
-	if err != nil {
-		return nil, err
+// Keyframe is the state at the start of a tick, before any of its inputs are applied.
+type Keyframe struct {
+	Tick  int
+	State *mgba.State
+}
+
+// IndexEntry points to where a keyframe's chunk starts in the replay file.
+type IndexEntry struct {
+	Tick   int
+	Offset int64
+}
+
+const (
+	recordTypeInput    uint8 = 0
+	recordTypeResult   uint8 = 1
+	recordTypeKeyframe uint8 = 2
+)
+
+const (
+	indexMagic      = "TIDX"
+	indexEntrySize  = 4 + 8
+	indexFooterSize = 4 + len(indexMagic)
+)
+
+func readMetadata(r io.Reader) (Metadata, error) {
+	var metadata Metadata
+
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return metadata, err
 	}
 
-	// read header
-	var header [4]byte
-	if _, err := io.ReadFull(zr, header[:]); err != nil {
-		return nil, err
+	raw := make([]byte, int(size))
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return metadata, err
 	}
 
-	if string(header[:]) != replayHeader {
-		return nil, fmt.Errorf("invalid format")
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return metadata, err
 	}
 
-	var version uint8
-	if err := binary.Read(zr, binary.LittleEndian, &version); err != nil {
-		return nil, err
+	return metadata, nil
+}
+
+func readInputPair(r io.Reader) ([2]input.Input, uint32, error) {
+	var inputPair [2]input.Input
+
+	var localTick uint32
+	if err := binary.Read(r, binary.LittleEndian, &localTick); err != nil {
+		return inputPair, 0, err
 	}
-	if version != replayVersion {
-		return nil, fmt.Errorf("unsupported replay version: %02x vs %02x", version, replayVersion)
+
+	var rest struct {
+		RemoteTick          uint32
+		RNGState            uint32
+		P1Joyflags          uint16
+		P1CustomScreenState uint8
+		P2Joyflags          uint16
+		P2CustomScreenState uint8
+		TurnFlags           uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &rest); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return inputPair, 0, err
 	}
 
-	// read inits
-	var init [2][]byte
+	inputPair[0].LocalTick = int(localTick)
+	inputPair[0].RemoteTick = int(rest.RemoteTick)
+	inputPair[0].Joyflags = rest.P1Joyflags
+	inputPair[0].CustomScreenState = rest.P1CustomScreenState
+	inputPair[1].LocalTick = int(rest.RemoteTick)
+	inputPair[1].RemoteTick = int(rest.RemoteTick)
+	inputPair[1].Joyflags = rest.P2Joyflags
+	inputPair[1].CustomScreenState = rest.P2CustomScreenState
+
 	for i := 0; i < 2; i++ {
-		var playerIndex uint8
-		if err := binary.Read(zr, binary.LittleEndian, &playerIndex); err != nil {
-			return nil, err
+		if rest.TurnFlags&(1<<i) == 0 {
+			continue
 		}
 
-		var marshaled [0x100]byte
-		if _, err := io.ReadFull(zr, marshaled[:]); err != nil {
-			return nil, err
+		var turn [0x100]byte
+		if _, err := io.ReadFull(r, turn[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return inputPair, 0, err
+		}
+		inputPair[i].Turn = turn[:]
+	}
+
+	return inputPair, rest.RNGState, nil
+}
+
+func readKeyframe(r io.Reader) (Keyframe, error) {
+	var keyframe Keyframe
+
+	var header struct {
+		Tick      uint32
+		StateSize uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return keyframe, err
+	}
+
+	stateBytes := make([]byte, int(header.StateSize))
+	if _, err := io.ReadFull(r, stateBytes); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return keyframe, err
+	}
+
+	keyframe.Tick = int(header.Tick)
+	keyframe.State = mgba.StateFromBytes(stateBytes)
+	return keyframe, nil
+}
+
+// isChunked reports whether a replay is in the chunked format, from the start of it. Anything else is assumed to be a legacy replay, which has no index or keyframes.
+func isChunked(rs io.ReadSeeker) (bool, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	var header struct {
+		Magic   [len(replayHeader)]byte
+		Version uint8
+	}
+	if err := binary.Read(rs, binary.LittleEndian, &header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
 		}
+		return false, err
+	}
+
+	if string(header.Magic[:]) != replayHeader {
+		return false, nil
+	}
 
-		init[playerIndex] = marshaled[:]
+	if header.Version != replayVersion {
+		return false, fmt.Errorf("unsupported replay version: %02x vs %02x", header.Version, replayVersion)
 	}
+	return true, nil
+}
 
-	// read state
-	var localPlayerIndex uint8
-	if err := binary.Read(zr, binary.LittleEndian, &localPlayerIndex); err != nil {
+// ReadIndex reads the keyframe index from the end of a replay, without decompressing any of it.
+//
+// Legacy replays and replays that were not closed properly have no index, in which case ReadIndex returns nil.
+func ReadIndex(rs io.ReadSeeker) ([]IndexEntry, error) {
+	chunked, err := isChunked(rs)
+	if err != nil || !chunked {
 		return nil, err
 	}
 
-	var stateSize uint32
-	if err := binary.Read(zr, binary.LittleEndian, &stateSize); err != nil {
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
 		return nil, err
 	}
 
-	stateBytes := make([]byte, int(stateSize))
-	if _, err := io.ReadFull(zr, stateBytes); err != nil {
+	if end < int64(chunkHeaderSize+indexFooterSize) {
+		return nil, nil
+	}
+
+	if _, err := rs.Seek(end-int64(indexFooterSize), io.SeekStart); err != nil {
 		return nil, err
 	}
-	state := mgba.StateFromBytes(stateBytes)
 
-	// read inputs
-	var inputPairs [][2]input.Input
-	var rngStates []uint32
-	for {
-		var localTick uint32
-		if err := binary.Read(zr, binary.LittleEndian, &localTick); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
-				break
-			}
-			return nil, err
-		}
+	var footer struct {
+		Count uint32
+		Magic [len(indexMagic)]byte
+	}
+	if err := binary.Read(rs, binary.LittleEndian, &footer); err != nil {
+		return nil, err
+	}
 
-		var remoteTick uint32
-		if err := binary.Read(zr, binary.LittleEndian, &remoteTick); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
-				break
-			}
-			return nil, err
-		}
+	if string(footer.Magic[:]) != indexMagic {
+		return nil, nil
+	}
 
-		// we don't do anything with this, actually...
-		var rngState uint32
-		if err := binary.Read(zr, binary.LittleEndian, &rngState); err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
-				break
-			}
-			return nil, err
+	// The footer alone isn't checked, so read the whole index chunk to check it against its crc32.
+	payloadSize := int64(footer.Count)*indexEntrySize + int64(indexFooterSize)
+	offset := end - payloadSize - chunkHeaderSize
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid index size")
+	}
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header, payload, err := readChunk(rs, offset)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != chunkTypeIndex || int64(len(payload)) != payloadSize {
+		return nil, fmt.Errorf("index footer does not match index chunk")
+	}
+	entries := bytes.NewReader(payload)
+
+	index := make([]IndexEntry, int(footer.Count))
+	for i := range index {
+		var raw struct {
+			Tick   uint32
+			Offset uint64
 		}
-		rngStates = append(rngStates, rngState)
-
-		var inputPair [2]input.Input
-		inputPair[0].LocalTick = int(localTick)
-		inputPair[0].RemoteTick = int(remoteTick)
-		inputPair[1].LocalTick = int(remoteTick)
-		inputPair[1].RemoteTick = int(remoteTick)
-
-		var p1Joyflags uint16
-		if err := binary.Read(zr, binary.LittleEndian, &p1Joyflags); err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
-				break
-			}
+		if err := binary.Read(entries, binary.LittleEndian, &raw); err != nil {
 			return nil, err
 		}
-		inputPair[0].Joyflags = p1Joyflags
+		index[i] = IndexEntry{Tick: int(raw.Tick), Offset: int64(raw.Offset)}
+	}
 
-		var p1CustomScreenState uint8
-		if err := binary.Read(zr, binary.LittleEndian, &p1CustomScreenState); err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
-				break
-			}
-			return nil, err
-		}
-		inputPair[0].CustomScreenState = p1CustomScreenState
+	return index, nil
+}
 
-		var p2Joyflags uint16
-		if err := binary.Read(zr, binary.LittleEndian, &p2Joyflags); err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
-				break
-			}
-			return nil, err
-		}
-		inputPair[1].Joyflags = p2Joyflags
+// ReadKeyframe reads a single keyframe pointed to by an index entry.
+func ReadKeyframe(rs io.ReadSeeker, entry IndexEntry) (Keyframe, error) {
+	if _, err := rs.Seek(entry.Offset, io.SeekStart); err != nil {
+		return Keyframe{}, err
+	}
 
-		var p2CustomScreenState uint8
-		if err := binary.Read(zr, binary.LittleEndian, &p2CustomScreenState); err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
-				break
-			}
-			return nil, err
-		}
-		inputPair[1].CustomScreenState = p2CustomScreenState
+	header, payload, err := readChunk(rs, entry.Offset)
+	if err != nil {
+		return Keyframe{}, err
+	}
+	if header.Type != chunkTypeData {
+		return Keyframe{}, fmt.Errorf("index entry does not point to a data chunk: chunk type %02x", header.Type)
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return Keyframe{}, err
+	}
+	defer dec.Close()
+
+	raw, err := dec.DecodeAll(payload, nil)
+	if err != nil {
+		return Keyframe{}, err
+	}
+	zr := bytes.NewReader(raw)
+
+	var recordType uint8
+	if err := binary.Read(zr, binary.LittleEndian, &recordType); err != nil {
+		return Keyframe{}, err
+	}
+
+	if recordType != recordTypeKeyframe {
+		return Keyframe{}, fmt.Errorf("index entry does not point to a keyframe: record type %02x", recordType)
+	}
+
+	keyframe, err := readKeyframe(zr)
+	if err != nil {
+		return Keyframe{}, err
+	}
+
+	if keyframe.Tick != entry.Tick {
+		return Keyframe{}, fmt.Errorf("keyframe tick does not match index: %d != %d", keyframe.Tick, entry.Tick)
+	}
+
+	return keyframe, nil
+}
+
+// Unmarshal reads a whole replay into memory. See NewReader for the format.
+func Unmarshal(r io.Reader) (*Replay, error) {
+	rr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.Close()
 
-		var turnFlags uint8
-		if err := binary.Read(zr, binary.LittleEndian, &turnFlags); err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				log.Printf("replay was truncated")
+	var inputPairs [][2]input.Input
+	var rngStates []uint32
+	var keyframes []Keyframe
+	for {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
 				break
 			}
 			return nil, err
 		}
 
-		if turnFlags&0b01 != 0 {
-			var turn [0x100]byte
-			if _, err := io.ReadFull(zr, turn[:]); err != nil {
-				if errors.Is(err, io.ErrUnexpectedEOF) {
-					log.Printf("replay was truncated")
-					break
-				}
-				return nil, err
-			}
-			inputPair[0].Turn = turn[:]
+		if tick.Keyframe != nil {
+			keyframes = append(keyframes, *tick.Keyframe)
 		}
-
-		if turnFlags&0b10 != 0 {
-			var turn [0x100]byte
-			if _, err := io.ReadFull(zr, turn[:]); err != nil {
-				if errors.Is(err, io.ErrUnexpectedEOF) {
-					log.Printf("replay was truncated")
-					break
-				}
-				return nil, err
-			}
-			inputPair[1].Turn = turn[:]
-		}
-
-		inputPairs = append(inputPairs, inputPair)
+		inputPairs = append(inputPairs, tick.InputPair)
+		rngStates = append(rngStates, tick.RNGState)
 	}
 
 	return &Replay{
-		State:            state,
-		LocalPlayerIndex: int(localPlayerIndex),
-		Init:             init,
+		Metadata:         rr.Header(),
+		State:            rr.State(),
+		LocalPlayerIndex: rr.LocalPlayerIndex(),
+		Init:             rr.Inits(),
 		InputPairs:       inputPairs,
 		RNGStates:        rngStates,
+		Keyframes:        keyframes,
 	}, nil
 }
@@ -1,72 +1,124 @@
 package replay
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"io"
-	"os"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/murkland/tango/input"
 	"github.com/murkland/tango/mgba"
 )
 
-const replayVersion = 0x08
+const replayVersion = 0x09
+
+// CurrentVersion is the version of the replay format that new replays are written in.
+const CurrentVersion = replayVersion
 const replayHeader = "TOOT"
 
-type Writer struct {
-	closer io.Closer
-	w      *zstd.Encoder
+// chunkTicks is the most input records that are batched into a single chunk. A crash loses at most this many ticks.
+const chunkTicks = 60
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
 }
 
-func NewWriter(filename string, core *mgba.Core) (*Writer, error) {
-	f, err := os.Create(filename)
+// syncWriter does the actual encoding and writing for a Writer.
+type syncWriter struct {
+	closer         io.Closer
+	cw             *countingWriter
+	enc            *zstd.Encoder
+	buf            bytes.Buffer
+	pendingRecords int
+	index          []IndexEntry
+}
+
+func newWriter(w io.Writer, closer io.Closer) (*syncWriter, error) {
+	cw := &countingWriter{w: w}
+
+	enc, err := zstd.NewWriter(nil)
 	if err != nil {
 		return nil, err
 	}
 
-	w, err := zstd.NewWriter(f)
-	if err != nil {
+	if _, err := cw.Write([]byte(replayHeader)); err != nil {
 		return nil, err
 	}
 
-	if _, err := w.Write([]byte(replayHeader)); err != nil {
+	if err := binary.Write(cw, binary.LittleEndian, uint8(replayVersion)); err != nil {
 		return nil, err
 	}
 
-	if err := binary.Write(w, binary.LittleEndian, uint8(replayVersion)); err != nil {
-		return nil, err
+	return &syncWriter{closer: closer, cw: cw, enc: enc}, nil
+}
+
+// Flush compresses everything written since the last flush into its own chunk.
+func (rw *syncWriter) Flush() error {
+	if rw.buf.Len() == 0 {
+		return nil
 	}
-	if err := w.Flush(); err != nil {
-		return nil, err
+
+	if err := writeChunk(rw.cw, chunkTypeData, rw.enc.EncodeAll(rw.buf.Bytes(), nil)); err != nil {
+		return err
+	}
+	rw.buf.Reset()
+	rw.pendingRecords = 0
+	return nil
+}
+
+func (rw *syncWriter) WriteMetadata(metadata Metadata) error {
+	raw, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint32(len(raw))); err != nil {
+		return err
+	}
+
+	if _, err := rw.buf.Write(raw); err != nil {
+		return err
+	}
+
+	if err := rw.Flush(); err != nil {
+		return err
 	}
 
-	return &Writer{f, w}, nil
+	return nil
 }
 
-func (rw *Writer) WriteState(playerIndex int, state *mgba.State) error {
-	if err := binary.Write(rw.w, binary.LittleEndian, uint8(playerIndex)); err != nil {
+func (rw *syncWriter) WriteState(playerIndex int, state *mgba.State) error {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint8(playerIndex)); err != nil {
 		return err
 	}
 
 	gs := state.Bytes()
-	if err := binary.Write(rw.w, binary.LittleEndian, uint32(len(gs))); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint32(len(gs))); err != nil {
 		return err
 	}
 
-	if _, err := rw.w.Write(gs); err != nil {
+	if _, err := rw.buf.Write(gs); err != nil {
 		return err
 	}
 
-	if err := rw.w.Flush(); err != nil {
+	if err := rw.Flush(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (rw *Writer) WriteInit(playerIndex int, marshaled []byte) error {
-	if err := binary.Write(rw.w, binary.LittleEndian, uint8(playerIndex)); err != nil {
+func (rw *syncWriter) WriteInit(playerIndex int, marshaled []byte) error {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint8(playerIndex)); err != nil {
 		return err
 	}
 
@@ -74,40 +126,77 @@ func (rw *Writer) WriteInit(playerIndex int, marshaled []byte) error {
 		return errors.New("invalid init size")
 	}
 
-	if _, err := rw.w.Write(marshaled); err != nil {
+	if _, err := rw.buf.Write(marshaled); err != nil {
+		return err
+	}
+
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteKeyframe writes the state at the start of the given tick, before any of its inputs are applied.
+//
+// Each keyframe gets its own chunk, so a reader can start decompressing from it without reading anything before it.
+func (rw *syncWriter) WriteKeyframe(tick int, state *mgba.State) error {
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	offset := rw.cw.n
+
+	if err := binary.Write(&rw.buf, binary.LittleEndian, recordTypeKeyframe); err != nil {
+		return err
+	}
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint32(tick)); err != nil {
+		return err
+	}
+
+	gs := state.Bytes()
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint32(len(gs))); err != nil {
+		return err
+	}
+
+	if _, err := rw.buf.Write(gs); err != nil {
 		return err
 	}
 
-	if err := rw.w.Flush(); err != nil {
+	if err := rw.Flush(); err != nil {
 		return err
 	}
 
+	rw.index = append(rw.index, IndexEntry{Tick: tick, Offset: offset})
+
 	return nil
 }
 
-func (rw *Writer) Write(rngState uint32, inputPair [2]input.Input) error {
+func (rw *syncWriter) Write(rngState uint32, inputPair [2]input.Input) error {
 	p1 := inputPair[0]
 	p2 := inputPair[1]
 
-	if err := binary.Write(rw.w, binary.LittleEndian, uint32(p1.LocalTick)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, recordTypeInput); err != nil {
 		return err
 	}
-	if err := binary.Write(rw.w, binary.LittleEndian, uint32(p1.RemoteTick)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint32(p1.LocalTick)); err != nil {
 		return err
 	}
-	if err := binary.Write(rw.w, binary.LittleEndian, uint32(rngState)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint32(p1.RemoteTick)); err != nil {
 		return err
 	}
-	if err := binary.Write(rw.w, binary.LittleEndian, uint16(p1.Joyflags)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint32(rngState)); err != nil {
 		return err
 	}
-	if err := binary.Write(rw.w, binary.LittleEndian, uint8(p1.CustomScreenState)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint16(p1.Joyflags)); err != nil {
 		return err
 	}
-	if err := binary.Write(rw.w, binary.LittleEndian, uint16(p2.Joyflags)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint8(p1.CustomScreenState)); err != nil {
 		return err
 	}
-	if err := binary.Write(rw.w, binary.LittleEndian, uint8(p2.CustomScreenState)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint16(p2.Joyflags)); err != nil {
+		return err
+	}
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint8(p2.CustomScreenState)); err != nil {
 		return err
 	}
 
@@ -118,7 +207,7 @@ func (rw *Writer) Write(rngState uint32, inputPair [2]input.Input) error {
 	if p2.Turn != nil {
 		turnFlags |= 0b10
 	}
-	if err := binary.Write(rw.w, binary.LittleEndian, uint8(turnFlags)); err != nil {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, uint8(turnFlags)); err != nil {
 		return err
 	}
 
@@ -127,7 +216,7 @@ func (rw *Writer) Write(rngState uint32, inputPair [2]input.Input) error {
 			return errors.New("invalid turn size")
 		}
 
-		if _, err := rw.w.Write(p1.Turn); err != nil {
+		if _, err := rw.buf.Write(p1.Turn); err != nil {
 			return err
 		}
 	}
@@ -137,24 +226,125 @@ func (rw *Writer) Write(rngState uint32, inputPair [2]input.Input) error {
 			return errors.New("invalid turn size")
 		}
 
-		if _, err := rw.w.Write(p2.Turn); err != nil {
+		if _, err := rw.buf.Write(p2.Turn); err != nil {
 			return err
 		}
 	}
 
-	if err := rw.w.Flush(); err != nil {
+	rw.pendingRecords++
+	if rw.pendingRecords >= chunkTicks {
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rw *syncWriter) WriteResult(result Result) error {
+	if err := binary.Write(&rw.buf, binary.LittleEndian, recordTypeResult); err != nil {
+		return err
+	}
+	if err := binary.Write(&rw.buf, binary.LittleEndian, result); err != nil {
+		return err
+	}
+
+	if err := rw.Flush(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (rw *Writer) Close() error {
-	if err := rw.w.Close(); err != nil {
+// writeIndex writes the keyframe index as the last chunk. It is not compressed, so it can be found from the end of the file.
+func (rw *syncWriter) writeIndex() error {
+	var payload bytes.Buffer
+
+	for _, entry := range rw.index {
+		if err := binary.Write(&payload, binary.LittleEndian, uint32(entry.Tick)); err != nil {
+			return err
+		}
+		if err := binary.Write(&payload, binary.LittleEndian, uint64(entry.Offset)); err != nil {
+			return err
+		}
+	}
+
+	if err := binary.Write(&payload, binary.LittleEndian, uint32(len(rw.index))); err != nil {
 		return err
 	}
-	if err := rw.closer.Close(); err != nil {
+	if _, err := payload.Write([]byte(indexMagic)); err != nil {
+		return err
+	}
+
+	return writeChunk(rw.cw, chunkTypeIndex, payload.Bytes())
+}
+
+// Close finishes the replay and closes the underlying file. The file is closed even if finishing the replay fails, and the first error is returned.
+func (rw *syncWriter) Close() error {
+	err := rw.finish()
+	if closeErr := rw.closer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// finish flushes anything still buffered and writes the index.
+func (rw *syncWriter) finish() error {
+	if err := rw.Flush(); err != nil {
 		return err
 	}
+	return rw.writeIndex()
+}
+
+// Abort closes the underlying file without writing anything more to it.
+func (rw *syncWriter) Abort() error {
+	return rw.closer.Close()
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
 	return nil
 }
+
+// Marshal writes a whole replay in the current format, including its keyframes and result.
+func Marshal(w io.Writer, r *Replay) error {
+	rw, err := newWriter(w, nopCloser{})
+	if err != nil {
+		return err
+	}
+
+	if err := rw.WriteMetadata(r.Metadata); err != nil {
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := rw.WriteInit(i, r.Init[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := rw.WriteState(r.LocalPlayerIndex, r.State); err != nil {
+		return err
+	}
+
+	keyframes := r.Keyframes
+	for i, ip := range r.InputPairs {
+		for len(keyframes) > 0 && keyframes[0].Tick <= ip[0].LocalTick {
+			if err := rw.WriteKeyframe(keyframes[0].Tick, keyframes[0].State); err != nil {
+				return err
+			}
+			keyframes = keyframes[1:]
+		}
+
+		if err := rw.Write(r.RNGStates[i], ip); err != nil {
+			return err
+		}
+	}
+
+	if err := rw.WriteResult(r.Metadata.Result); err != nil {
+		return err
+	}
+
+	return rw.Close()
+}
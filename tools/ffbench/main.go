@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/murkland/tango/bn6"
+	"github.com/murkland/tango/game"
+	"github.com/murkland/tango/input"
+	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/replay"
+)
+
+var (
+	romPath          = flag.String("rom_path", "bn6.gba", "path to rom")
+	maxDepth         = flag.Int("max_depth", 8, "maximum synthetic rollback depth to benchmark")
+	maxTicks         = flag.Int("max_ticks", 0, "maximum number of ticks to fastforward per depth (0 = whole replay)")
+	keyframeInterval = flag.Int("keyframe_interval", 600, "ticks between replay keyframes (0 = no keyframes)")
+)
+
+type result struct {
+	depth      int
+	durations  []time.Duration
+	mallocs    uint64
+	totalAlloc uint64
+}
+
+func (r *result) percentile(p float64) time.Duration {
+	if len(r.durations) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.durations)-1) * p)
+	return r.durations[i]
+}
+
+func bench(ff *game.Fastforwarder, rw *replay.Writer, state *mgba.State, localPlayerIndex int, inputPairs [][2]input.Input, depth int) (*result, error) {
+	n := len(inputPairs) - depth
+	if *maxTicks > 0 && n > *maxTicks {
+		n = *maxTicks
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("replay too short for depth %d", depth)
+	}
+
+	res := &result{depth: depth, durations: make([]time.Duration, 0, n)}
+
+	lastCommittedRemoteInput := input.Input{Joyflags: 0xfc00}
+
+	localInputsLeft := make([]input.Input, depth)
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < n; i++ {
+		for j := 0; j < depth; j++ {
+			localInputsLeft[j] = inputPairs[i+1+j][localPlayerIndex]
+		}
+
+		startTime := time.Now()
+		committedState, _, _, err := ff.Fastforward(state, rw, localPlayerIndex, inputPairs[i:i+1:i+1], lastCommittedRemoteInput, localInputsLeft)
+		if err != nil {
+			return nil, fmt.Errorf("tick %d: %w", inputPairs[i][0].LocalTick, err)
+		}
+		res.durations = append(res.durations, time.Now().Sub(startTime))
+
+		state = committedState
+		lastCommittedRemoteInput = inputPairs[i][1-localPlayerIndex]
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	res.mallocs = after.Mallocs - before.Mallocs
+	res.totalAlloc = after.TotalAlloc - before.TotalAlloc
+
+	sort.Slice(res.durations, func(i, j int) bool { return res.durations[i] < res.durations[j] })
+	return res, nil
+}
+
+func main() {
+	flag.Parse()
+
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	replayName := flag.Arg(0)
+	f, err := os.Open(replayName)
+	if err != nil {
+		log.Panicf("failed to open replay: %s", err)
+	}
+	defer f.Close()
+
+	rr, err := replay.NewReader(f)
+	if err != nil {
+		log.Panicf("failed to open replay: %s", err)
+	}
+	defer rr.Close()
+
+	state := rr.State()
+	bn6 := bn6.Load(state.ROMTitle)
+	if bn6 == nil {
+		log.Panicf("unsupported game: %s", state.ROMTitle)
+	}
+
+	ff, err := game.NewFastforwarder(*romPath, bn6)
+	if err != nil {
+		log.Panicf("failed to make fastforwarder: %s", err)
+	}
+
+	// The inputs are all read up front, so decoding them isn't counted in the timings or allocations. Keyframes aren't needed, so they aren't kept.
+	var inputPairs [][2]input.Input
+	for {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			log.Panicf("failed to read replay: %s", err)
+		}
+
+		// The fastforwarder expects both halves of an input pair to be for the same tick, but the replay stores the remote tick for p2.
+		ip := tick.InputPair
+		ip[1].LocalTick = ip[0].LocalTick
+		inputPairs = append(inputPairs, ip)
+	}
+
+	// Committed inputs get written to the replay writer as they would in a real battle, so that cost is included too.
+	rw, err := replay.NewWriter(os.DevNull, *keyframeInterval)
+	if err != nil {
+		log.Panicf("failed to open replay writer: %s", err)
+	}
+	defer rw.Close()
+
+	fmt.Fprintf(os.Stdout, "%5s %7s %12s %12s %12s %12s %12s %10s %12s\n", "depth", "n", "p50", "p90", "p99", "max", "mean", "allocs/op", "bytes/op")
+	for depth := 1; depth <= *maxDepth; depth++ {
+		res, err := bench(ff, rw, state, rr.LocalPlayerIndex(), inputPairs, depth)
+		if err != nil {
+			log.Panicf("failed to benchmark: %s", err)
+		}
+
+		var total time.Duration
+		for _, d := range res.durations {
+			total += d
+		}
+		n := len(res.durations)
+
+		fmt.Fprintf(os.Stdout, "%5d %7d %12s %12s %12s %12s %12s %10d %12d\n",
+			res.depth, n,
+			res.percentile(0.50), res.percentile(0.90), res.percentile(0.99), res.durations[n-1], total/time.Duration(n),
+			res.mallocs/uint64(n), res.totalAlloc/uint64(n))
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 
@@ -32,20 +34,36 @@ func main() {
 	}
 	defer f.Close()
 
-	replay, err := replay.Unmarshal(f)
+	rr, err := replay.NewReader(f)
 	if err != nil {
 		log.Panicf("failed to open replay: %s", err)
 	}
+	defer rr.Close()
 
+	fmt.Fprintf(os.Stdout, "metadata: %+v\n", rr.Header())
+
+	inits := rr.Inits()
 	for i := 0; i < 2; i++ {
-		fmt.Fprintf(os.Stdout, "init p%d: %s\n", i+1, hex.EncodeToString(replay.Init[i]))
+		fmt.Fprintf(os.Stdout, "init p%d: %s\n", i+1, hex.EncodeToString(inits[i]))
 	}
 
-	for i, inputPair := range replay.InputPairs {
-		p1 := inputPair[0]
-		p2 := inputPair[1]
+	for {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			log.Panicf("failed to read replay: %s", err)
+		}
+
+		if tick.Keyframe != nil {
+			fmt.Fprintf(os.Stdout, "keyframe: tick=%d size=%d\n", tick.Keyframe.Tick, len(tick.Keyframe.State.Bytes()))
+		}
+
+		p1 := tick.InputPair[0]
+		p2 := tick.InputPair[1]
 
-		fmt.Fprintf(os.Stdout, "%d: rngstate=%08x p1joyflags=%04x p2joyflags=%04x p1custstate=%d p2custstate=%d\n", p1.LocalTick, replay.RNGStates[i], p1.Joyflags, p2.Joyflags, p1.CustomScreenState, p2.CustomScreenState)
+		fmt.Fprintf(os.Stdout, "%d: rngstate=%08x p1joyflags=%04x p2joyflags=%04x p1custstate=%d p2custstate=%d\n", p1.LocalTick, tick.RNGState, p1.Joyflags, p2.Joyflags, p1.CustomScreenState, p2.CustomScreenState)
 
 		if p1.Turn != nil {
 			fmt.Fprintf(os.Stdout, " +p1 turn: %s\n", hex.EncodeToString(p1.Turn))
@@ -55,4 +73,6 @@ func main() {
 			fmt.Fprintf(os.Stdout, " +p2 turn: %s\n", hex.EncodeToString(p2.Turn))
 		}
 	}
+
+	fmt.Fprintf(os.Stdout, "result: %s\n", rr.Header().Result)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/replay"
+	"github.com/murkland/tango/tools/replaylib/queryflags"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <list|reindex> [flags]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	replaysDir := fs.String("replays_dir", "replays", "path to replays directory")
+	var q replay.LibraryQuery
+	queryflags.Bind(fs, &q)
+	fs.Parse(args)
+
+	lib, err := replay.OpenLibrary(*replaysDir)
+	if err != nil {
+		log.Panicf("failed to open replay library: %s", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "date\trom\tside\tlength\tresult\tfilename\n")
+	for _, entry := range lib.Query(q) {
+		fmt.Fprintf(tw, "%s\t%s\tp%d\t%s\t%s\t%s\n", entry.Date.Format("2006-01-02 15:04:05"), entry.ROMTitle, entry.LocalPlayerIndex+1, entry.Duration(), entry.Result, entry.Filename)
+	}
+	tw.Flush()
+}
+
+func reindex(args []string) {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	replaysDir := fs.String("replays_dir", "replays", "path to replays directory")
+	fs.Parse(args)
+
+	if err := os.Remove(replay.LibraryIndexPath(*replaysDir)); err != nil && !os.IsNotExist(err) {
+		log.Panicf("failed to remove replay library index: %s", err)
+	}
+
+	if _, err := replay.OpenLibrary(*replaysDir); err != nil {
+		log.Panicf("failed to open replay library: %s", err)
+	}
+}
+
+func main() {
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "list":
+		list(os.Args[2:])
+	case "reindex":
+		reindex(os.Args[2:])
+	default:
+		usage()
+	}
+}
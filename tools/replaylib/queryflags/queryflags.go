@@ -0,0 +1,42 @@
+// Package queryflags lets the replay tools filter and sort the replay library from the command line.
+package queryflags
+
+import (
+	"flag"
+	"time"
+
+	"github.com/murkland/tango/replay"
+)
+
+// Bind registers flags for filtering and sorting a replay library query on a flag set.
+func Bind(fs *flag.FlagSet, q *replay.LibraryQuery) {
+	fs.StringVar(&q.ROMTitle, "rom", "", "only show replays for roms with titles containing this")
+	fs.Func("result", "only show replays with this result (win, loss, unknown)", func(s string) error {
+		var result replay.Result
+		if err := result.UnmarshalText([]byte(s)); err != nil {
+			return err
+		}
+		q.Result = &result
+		return nil
+	})
+	fs.Func("since", "only show replays from this date onwards (YYYY-MM-DD)", func(s string) error {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return err
+		}
+		q.Since = t
+		return nil
+	})
+	fs.Func("until", "only show replays from before this date (YYYY-MM-DD)", func(s string) error {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return err
+		}
+		q.Until = t
+		return nil
+	})
+	fs.Func("sort", "sort replays by this key (date, length, rom)", func(s string) error {
+		return q.SortKey.UnmarshalText([]byte(s))
+	})
+	fs.BoolVar(&q.Ascending, "ascending", false, "sort in ascending order instead of descending")
+}
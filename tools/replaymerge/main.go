@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/murkland/tango/input"
+	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/replay"
+)
+
+var (
+	outPath = flag.String("o", "", "path to write the merged replay to, if both replays agree")
+)
+
+// replayFile is a replay that is read one tick at a time.
+type replayFile struct {
+	f *os.File
+	*replay.Reader
+
+	// ticks is how many ticks have been read so far.
+	ticks int
+}
+
+func openReplay(path string) (*replayFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rr, err := replay.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &replayFile{f: f, Reader: rr}, nil
+}
+
+func (rf *replayFile) Close() {
+	rf.Reader.Close()
+	rf.f.Close()
+}
+
+// next returns the next tick, or nil once there are no more.
+func (rf *replayFile) next() (*replay.Tick, error) {
+	tick, err := rf.Next()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rf.ticks++
+	return &tick, nil
+}
+
+// drain reads the rest of the replay, so its result and length are known.
+func (rf *replayFile) drain() error {
+	for {
+		tick, err := rf.next()
+		if err != nil || tick == nil {
+			return err
+		}
+	}
+}
+
+func opposite(result replay.Result) replay.Result {
+	switch result {
+	case replay.ResultWin:
+		return replay.ResultLoss
+	case replay.ResultLoss:
+		return replay.ResultWin
+	default:
+		return replay.ResultUnknown
+	}
+}
+
+// diffInput compares the parts of an input that both sides must agree on. The remote tick is left out, since it's only used for timing.
+func diffInput(a input.Input, b input.Input) string {
+	if a.Joyflags != b.Joyflags {
+		return fmt.Sprintf("joyflags %04x != %04x", a.Joyflags, b.Joyflags)
+	}
+	if a.CustomScreenState != b.CustomScreenState {
+		return fmt.Sprintf("custom screen state %d != %d", a.CustomScreenState, b.CustomScreenState)
+	}
+	if (a.Turn == nil) != (b.Turn == nil) {
+		return fmt.Sprintf("turn present %t != %t", a.Turn != nil, b.Turn != nil)
+	}
+	if !bytes.Equal(a.Turn, b.Turn) {
+		return fmt.Sprintf("turn data differs:\n    %s\n    %s", hex.EncodeToString(a.Turn), hex.EncodeToString(b.Turn))
+	}
+	return ""
+}
+
+// check reports every way in which the two replays disagree, stopping at the first input that differs. Both replays are read to the end.
+func check(p1 *replayFile, p2 *replayFile) ([]string, error) {
+	var problems []string
+
+	m1 := p1.Header()
+	m2 := p2.Header()
+
+	if m1.ROMTitle != m2.ROMTitle || m1.ROMCRC32 != m2.ROMCRC32 {
+		problems = append(problems, fmt.Sprintf("roms differ: %s (%08x) != %s (%08x)", m1.ROMTitle, m1.ROMCRC32, m2.ROMTitle, m2.ROMCRC32))
+	}
+
+	if m1.SessionID != "" && m2.SessionID != "" && m1.SessionID != m2.SessionID {
+		problems = append(problems, fmt.Sprintf("session ids differ: %s != %s", m1.SessionID, m2.SessionID))
+	}
+
+	if m1.BattleNumber != m2.BattleNumber {
+		problems = append(problems, fmt.Sprintf("battle numbers differ: %d != %d", m1.BattleNumber, m2.BattleNumber))
+	}
+
+	for i := 0; i < 2; i++ {
+		if !bytes.Equal(p1.Inits()[i], p2.Inits()[i]) {
+			problems = append(problems, fmt.Sprintf("p%d init differs:\n    %s\n    %s", i+1, hex.EncodeToString(p1.Inits()[i]), hex.EncodeToString(p2.Inits()[i])))
+		}
+	}
+
+	inputProblems, err := checkInputs(p1, p2)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p1.drain(); err != nil {
+		return nil, err
+	}
+	if err := p2.drain(); err != nil {
+		return nil, err
+	}
+
+	if p1.ticks != p2.ticks {
+		fmt.Fprintf(os.Stdout, "note: p1 has %d inputs, p2 has %d inputs\n", p1.ticks, p2.ticks)
+	}
+
+	// The results are at the end of the replays, so they can only be checked once both have been read.
+	r1 := p1.Header().Result
+	r2 := p2.Header().Result
+	if r1 != replay.ResultUnknown && r2 != replay.ResultUnknown && r1 != opposite(r2) {
+		problems = append(problems, fmt.Sprintf("results conflict: p1 says %s, p2 says %s", r1, r2))
+	}
+
+	return append(problems, inputProblems...), nil
+}
+
+// checkInputs compares the replays' inputs tick by tick until one of them runs out or they differ.
+func checkInputs(p1 *replayFile, p2 *replayFile) ([]string, error) {
+	t1, err := p1.next()
+	if err != nil {
+		return nil, err
+	}
+	t2, err := p2.next()
+	if err != nil {
+		return nil, err
+	}
+	if t1 == nil || t2 == nil {
+		return nil, nil
+	}
+
+	var problems []string
+
+	// Both replays should start at the same tick, but line them up anyway in case they don't.
+	if t1.InputPair[0].LocalTick != t2.InputPair[0].LocalTick {
+		problems = append(problems, fmt.Sprintf("replays start at different ticks: %d != %d", t1.InputPair[0].LocalTick, t2.InputPair[0].LocalTick))
+	}
+	for t1 != nil && t2 != nil && t1.InputPair[0].LocalTick < t2.InputPair[0].LocalTick {
+		if t1, err = p1.next(); err != nil {
+			return nil, err
+		}
+	}
+	for t1 != nil && t2 != nil && t2.InputPair[0].LocalTick < t1.InputPair[0].LocalTick {
+		if t2, err = p2.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	for t1 != nil && t2 != nil {
+		ip1 := t1.InputPair
+		ip2 := t2.InputPair
+
+		tick := ip1[0].LocalTick
+		if ip2[0].LocalTick != tick {
+			return append(problems, fmt.Sprintf("tick %d: ticks out of step: %d != %d", tick, tick, ip2[0].LocalTick)), nil
+		}
+
+		for k := 0; k < 2; k++ {
+			if diff := diffInput(ip1[k], ip2[k]); diff != "" {
+				return append(problems, fmt.Sprintf("tick %d: p%d input: %s", tick, k+1, diff)), nil
+			}
+		}
+
+		if t1.RNGState != t2.RNGState {
+			return append(problems, fmt.Sprintf("tick %d: rng states differ: %08x != %08x", tick, t1.RNGState, t2.RNGState)), nil
+		}
+
+		if t1, err = p1.next(); err != nil {
+			return nil, err
+		}
+		if t2, err = p2.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	return problems, nil
+}
+
+// merge writes a canonical replay from p1's perspective, filling in anything p1's replay is missing from p2's. Both replays must not have been read past their preambles yet.
+func merge(path string, p1 *replayFile, p2 *replayFile) error {
+	rw, err := replay.NewWriter(path, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := writeMerged(rw, p1, p2); err != nil {
+		rw.Close()
+		return err
+	}
+
+	return rw.Close()
+}
+
+func writeMerged(rw *replay.Writer, p1 *replayFile, p2 *replayFile) error {
+	if err := rw.WriteMetadata(p1.Header()); err != nil {
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := rw.WriteInit(i, p1.Inits()[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := rw.WriteState(p1.LocalPlayerIndex(), p1.State()); err != nil {
+		return err
+	}
+
+	lastTick := -1
+	for {
+		tick, err := p1.next()
+		if err != nil {
+			return err
+		}
+		if tick == nil {
+			break
+		}
+
+		if tick.Keyframe != nil {
+			if err := rw.WriteKeyframe(tick.Keyframe.Tick, tick.Keyframe.State); err != nil {
+				return err
+			}
+		}
+		if err := rw.Write(tick.RNGState, tick.InputPair); err != nil {
+			return err
+		}
+		lastTick = tick.InputPair[0].LocalTick
+	}
+
+	// If p1's replay was cut short, e.g. by a disconnect, p2's might have more committed inputs.
+	for {
+		tick, err := p2.next()
+		if err != nil {
+			return err
+		}
+		if tick == nil {
+			break
+		}
+
+		if tick.InputPair[0].LocalTick <= lastTick {
+			continue
+		}
+		if err := rw.Write(tick.RNGState, tick.InputPair); err != nil {
+			return err
+		}
+	}
+
+	result := p1.Header().Result
+	if result == replay.ResultUnknown {
+		result = opposite(p2.Header().Result)
+	}
+	return rw.WriteResult(result)
+}
+
+// sortPaths puts the paths of the two replays in player order, p1's first.
+func sortPaths(a string, b string) ([2]string, error) {
+	ra, err := openReplay(a)
+	if err != nil {
+		return [2]string{}, fmt.Errorf("%s: %w", a, err)
+	}
+	defer ra.Close()
+
+	rb, err := openReplay(b)
+	if err != nil {
+		return [2]string{}, fmt.Errorf("%s: %w", b, err)
+	}
+	defer rb.Close()
+
+	if ra.LocalPlayerIndex() == rb.LocalPlayerIndex() {
+		return [2]string{}, fmt.Errorf("both replays are from p%d's perspective", ra.LocalPlayerIndex()+1)
+	}
+
+	if ra.LocalPlayerIndex() != 0 {
+		return [2]string{b, a}, nil
+	}
+	return [2]string{a, b}, nil
+}
+
+func openPair(paths [2]string) (*replayFile, *replayFile, error) {
+	p1, err := openReplay(paths[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", paths[0], err)
+	}
+
+	p2, err := openReplay(paths[1])
+	if err != nil {
+		p1.Close()
+		return nil, nil, fmt.Errorf("%s: %w", paths[1], err)
+	}
+
+	return p1, p2, nil
+}
+
+func main() {
+	flag.Parse()
+
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	if flag.NArg() != 2 {
+		log.Panicf("usage: %s [flags] <replay> <replay>", os.Args[0])
+	}
+
+	paths, err := sortPaths(flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		log.Panicf("failed to open replays: %s", err)
+	}
+
+	p1, p2, err := openPair(paths)
+	if err != nil {
+		log.Panicf("failed to open replays: %s", err)
+	}
+
+	problems, err := check(p1, p2)
+	p1.Close()
+	p2.Close()
+	if err != nil {
+		log.Panicf("failed to read replays: %s", err)
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stdout, "%s\n", problem)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stdout, "replays agree\n")
+
+	if *outPath == "" {
+		return
+	}
+
+	// Checking read both replays all the way through, so open them again to merge them.
+	p1, p2, err = openPair(paths)
+	if err != nil {
+		log.Panicf("failed to open replays: %s", err)
+	}
+	defer p1.Close()
+	defer p2.Close()
+
+	if err := merge(*outPath, p1, p2); err != nil {
+		log.Panicf("failed to write merged replay: %s", err)
+	}
+}
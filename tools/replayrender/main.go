@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/murkland/tango/av"
+	"github.com/murkland/tango/game"
+	"github.com/murkland/tango/mgba"
+)
+
+var (
+	romPath     = flag.String("rom_path", "bn6.gba", "path to rom")
+	videoPath   = flag.String("video", "", "path to write video to: a .y4m file, or a directory to write a png sequence to if -format=png")
+	videoFormat = flag.String("format", "y4m", "video format to write (y4m, png)")
+	audioPath   = flag.String("audio", "", "path to write audio to as a .wav file")
+	scale       = flag.Int("scale", 1, "integer factor to scale video by")
+	startTick   = flag.Int("start_tick", 0, "first in-battle tick to render")
+	endTick     = flag.Int("end_tick", -1, "last in-battle tick to render (-1 = until the end of the battle)")
+)
+
+// The GBA runs at 16777216 Hz with 280896 cycles per frame, which is 262144/4389 frames per second.
+const (
+	fpsNum = 262144
+	fpsDen = 4389
+)
+
+type frameWriter interface {
+	WriteFrame(img *image.NRGBA) error
+	Close() error
+}
+
+type y4mWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	ycbcr []byte
+}
+
+func newY4MWriter(path string, width int, height int) (*y4mWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	if _, err := fmt.Fprintf(w, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C444\n", width, height, fpsNum, fpsDen); err != nil {
+		return nil, err
+	}
+
+	return &y4mWriter{f, w, make([]byte, width*height*3)}, nil
+}
+
+func (yw *y4mWriter) WriteFrame(img *image.NRGBA) error {
+	n := img.Rect.Dx() * img.Rect.Dy()
+	for i := 0; i < n; i++ {
+		r := int32(img.Pix[i*4+0])
+		g := int32(img.Pix[i*4+1])
+		b := int32(img.Pix[i*4+2])
+
+		// BT.601, limited range.
+		yw.ycbcr[i] = uint8((66*r+129*g+25*b+128)>>8 + 16)
+		yw.ycbcr[n+i] = uint8((-38*r-74*g+112*b+128)>>8 + 128)
+		yw.ycbcr[2*n+i] = uint8((112*r-94*g-18*b+128)>>8 + 128)
+	}
+
+	if _, err := yw.w.WriteString("FRAME\n"); err != nil {
+		return err
+	}
+	if _, err := yw.w.Write(yw.ycbcr); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (yw *y4mWriter) Close() error {
+	if err := yw.w.Flush(); err != nil {
+		return err
+	}
+	return yw.f.Close()
+}
+
+type pngSequenceWriter struct {
+	dir string
+	n   int
+}
+
+func newPNGSequenceWriter(dir string) (*pngSequenceWriter, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &pngSequenceWriter{dir, 0}, nil
+}
+
+func (pw *pngSequenceWriter) WriteFrame(img *image.NRGBA) error {
+	f, err := os.Create(filepath.Join(pw.dir, fmt.Sprintf("%06d.png", pw.n)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	pw.n++
+	return nil
+}
+
+func (pw *pngSequenceWriter) Close() error {
+	return nil
+}
+
+type wavWriter struct {
+	f          *os.File
+	w          *bufio.Writer
+	sampleRate int
+	dataSize   int
+}
+
+func newWAVWriter(path string, sampleRate int) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ww := &wavWriter{f, bufio.NewWriter(f), sampleRate, 0}
+	if err := ww.writeHeader(); err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+func (ww *wavWriter) writeHeader() error {
+	const channels = 2
+	const bitsPerSample = 16
+	blockAlign := channels * bitsPerSample / 8
+
+	var header struct {
+		RIFF          [4]byte
+		RIFFSize      uint32
+		WAVE          [4]byte
+		Fmt           [4]byte
+		FmtSize       uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Data          [4]byte
+		DataSize      uint32
+	}
+	copy(header.RIFF[:], "RIFF")
+	header.RIFFSize = uint32(36 + ww.dataSize)
+	copy(header.WAVE[:], "WAVE")
+	copy(header.Fmt[:], "fmt ")
+	header.FmtSize = 16
+	header.AudioFormat = 1
+	header.Channels = channels
+	header.SampleRate = uint32(ww.sampleRate)
+	header.ByteRate = uint32(ww.sampleRate * blockAlign)
+	header.BlockAlign = uint16(blockAlign)
+	header.BitsPerSample = bitsPerSample
+	copy(header.Data[:], "data")
+	header.DataSize = uint32(ww.dataSize)
+
+	return binary.Write(ww.w, binary.LittleEndian, header)
+}
+
+func (ww *wavWriter) WriteSamples(samples []int16) error {
+	if err := binary.Write(ww.w, binary.LittleEndian, samples); err != nil {
+		return err
+	}
+	ww.dataSize += len(samples) * 2
+	return nil
+}
+
+func (ww *wavWriter) Close() error {
+	if err := ww.w.Flush(); err != nil {
+		return err
+	}
+
+	// Go back and fill in the sizes now that we know them.
+	if _, err := ww.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	ww.w.Reset(ww.f)
+	if err := ww.writeHeader(); err != nil {
+		return err
+	}
+	if err := ww.w.Flush(); err != nil {
+		return err
+	}
+
+	return ww.f.Close()
+}
+
+func scaleFrame(dst *image.NRGBA, src []byte, width int, height int, k int) {
+	for y := 0; y < height*k; y++ {
+		for x := 0; x < width*k; x++ {
+			si := ((y/k)*width + x/k) * 4
+			di := y*dst.Stride + x*4
+			dst.Pix[di+0] = src[si+0]
+			dst.Pix[di+1] = src[si+1]
+			dst.Pix[di+2] = src[si+2]
+			dst.Pix[di+3] = 0xff
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	if *videoPath == "" && *audioPath == "" {
+		log.Panicf("at least one of -video or -audio must be specified")
+	}
+
+	if *scale < 1 {
+		log.Panicf("scale must be at least 1")
+	}
+
+	replayName := flag.Arg(0)
+	f, err := os.Open(replayName)
+	if err != nil {
+		log.Panicf("failed to open replay: %s", err)
+	}
+	defer f.Close()
+
+	replayer, err := game.NewReplayer(*romPath, f)
+	if err != nil {
+		log.Panicf("failed to make replayer: %s", err)
+	}
+	defer replayer.Close()
+	// Rendering never seeks, so snapshots would only use up memory.
+	replayer.SetSnapshotInterval(0)
+
+	core := replayer.Core()
+
+	width, height := core.DesiredVideoDimensions()
+	vb := av.NewVideoBuffer(width, height)
+	core.SetVideoBuffer(vb.Pointer(), width)
+
+	var fw frameWriter
+	if *videoPath != "" {
+		switch *videoFormat {
+		case "y4m":
+			fw, err = newY4MWriter(*videoPath, width**scale, height**scale)
+		case "png":
+			fw, err = newPNGSequenceWriter(*videoPath)
+		default:
+			log.Panicf("unknown video format: %s", *videoFormat)
+		}
+		if err != nil {
+			log.Panicf("failed to open video output: %s", err)
+		}
+	}
+
+	sampleRate := core.Options().SampleRate
+	var ww *wavWriter
+	if *audioPath != "" {
+		ww, err = newWAVWriter(*audioPath, sampleRate)
+		if err != nil {
+			log.Panicf("failed to open audio output: %s", err)
+		}
+	}
+
+	ended := false
+	replayer.SetEndedCallback(func() {
+		ended = true
+	})
+	replayer.Reset()
+
+	left := core.AudioChannel(0)
+	right := core.AudioChannel(1)
+	left.SetRates(float64(core.Frequency()), float64(sampleRate))
+	right.SetRates(float64(core.Frequency()), float64(sampleRate))
+	samples := make([]int16, core.AudioBufferSize()*2)
+
+	img := image.NewNRGBA(image.Rect(0, 0, width**scale, height**scale))
+
+	frames := 0
+	for !ended {
+		core.RunFrame()
+
+		tick := int(replayer.BN6().InBattleTime(core))
+		inRange := tick >= *startTick && (*endTick < 0 || tick <= *endTick)
+
+		// Always drain audio, even if we're not writing it, so the buffers don't fill up.
+		for left.SamplesAvail() > 0 {
+			n := left.SamplesAvail()
+			if n > len(samples)/2 {
+				n = len(samples) / 2
+			}
+			left.ReadSamples(unsafe.Pointer(&samples[0]), n, true)
+			right.ReadSamples(unsafe.Pointer(&samples[1]), n, true)
+			if ww != nil && inRange {
+				if err := ww.WriteSamples(samples[:n*2]); err != nil {
+					log.Panicf("failed to write audio: %s", err)
+				}
+			}
+		}
+
+		if *endTick >= 0 && tick > *endTick {
+			break
+		}
+
+		if !inRange {
+			continue
+		}
+
+		if fw != nil {
+			scaleFrame(img, vb.Pix(), width, height, *scale)
+			if err := fw.WriteFrame(img); err != nil {
+				log.Panicf("failed to write video: %s", err)
+			}
+		}
+		frames++
+	}
+
+	if fw != nil {
+		if err := fw.Close(); err != nil {
+			log.Panicf("failed to close video output: %s", err)
+		}
+	}
+
+	if ww != nil {
+		if err := ww.Close(); err != nil {
+			log.Panicf("failed to close audio output: %s", err)
+		}
+	}
+
+	if err := replayer.Err(); err != nil {
+		log.Panicf("failed to read replay: %s", err)
+	}
+
+	log.Printf("rendered %d frames", frames)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/replay"
+)
+
+var (
+	indent = flag.Bool("indent", false, "indent the json output")
+)
+
+const ticksPerSecond = 60
+
+type PlayerStats struct {
+	CustomScreenTicks   int     `json:"custom_screen_ticks"`
+	CustomScreenSeconds float64 `json:"custom_screen_seconds"`
+	ButtonPresses       int     `json:"button_presses"`
+	InputsPerMinute     float64 `json:"inputs_per_minute"`
+	TurnTicks           []int   `json:"turn_ticks"`
+}
+
+// TurnStats describes when a turn was committed.
+type TurnStats struct {
+	Number int `json:"number"`
+	// PlayerTicks is when each player committed their turn, or -1 if they never did.
+	PlayerTicks [2]int `json:"player_ticks"`
+	// TicksSincePrevious is the number of ticks since the previous turn was committed by both players, or since the start of the battle.
+	TicksSincePrevious int `json:"ticks_since_previous"`
+}
+
+type Stats struct {
+	Filename         string        `json:"filename"`
+	ROMTitle         string        `json:"rom_title"`
+	BattleNumber     int           `json:"battle_number"`
+	LocalPlayerIndex int           `json:"local_player_index"`
+	Result           replay.Result `json:"result"`
+	StartTime        *time.Time    `json:"start_time,omitempty"`
+
+	Ticks           int     `json:"ticks"`
+	DurationSeconds float64 `json:"duration_seconds"`
+
+	Players [2]PlayerStats `json:"players"`
+	Turns   []TurnStats    `json:"turns"`
+}
+
+func analyze(path string) (*Stats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rr, err := replay.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.Close()
+
+	stats := &Stats{
+		Filename:         filepath.Base(path),
+		LocalPlayerIndex: rr.LocalPlayerIndex(),
+	}
+	for i := range stats.Players {
+		stats.Players[i].TurnTicks = []int{}
+	}
+
+	firstTick := -1
+	var lastJoyflags [2]uint16
+	for {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		t := tick.InputPair[0].LocalTick
+		if firstTick < 0 {
+			firstTick = t
+		}
+		stats.Ticks++
+
+		for i, inp := range tick.InputPair {
+			ps := &stats.Players[i]
+
+			if inp.CustomScreenState != 0 {
+				ps.CustomScreenTicks++
+			}
+
+			// Only count buttons going down, not being held.
+			joyflags := inp.Joyflags & 0x3ff
+			for pressed := joyflags &^ lastJoyflags[i]; pressed != 0; pressed &= pressed - 1 {
+				ps.ButtonPresses++
+			}
+			lastJoyflags[i] = joyflags
+
+			if inp.Turn != nil {
+				ps.TurnTicks = append(ps.TurnTicks, t-firstTick)
+			}
+		}
+	}
+
+	metadata := rr.Header()
+	stats.ROMTitle = metadata.ROMTitle
+	stats.BattleNumber = metadata.BattleNumber
+	stats.Result = metadata.Result
+	if !metadata.StartTime.IsZero() {
+		stats.StartTime = &metadata.StartTime
+	}
+
+	stats.DurationSeconds = float64(stats.Ticks) / ticksPerSecond
+	for i := range stats.Players {
+		ps := &stats.Players[i]
+		ps.CustomScreenSeconds = float64(ps.CustomScreenTicks) / ticksPerSecond
+		if stats.DurationSeconds > 0 {
+			ps.InputsPerMinute = float64(ps.ButtonPresses) / (stats.DurationSeconds / 60)
+		}
+	}
+
+	// Each player commits exactly one turn per turn, so pair them up in order.
+	numTurns := len(stats.Players[0].TurnTicks)
+	if n := len(stats.Players[1].TurnTicks); n > numTurns {
+		numTurns = n
+	}
+	stats.Turns = make([]TurnStats, numTurns)
+	previous := 0
+	for i := range stats.Turns {
+		turn := &stats.Turns[i]
+		turn.Number = i + 1
+
+		last := -1
+		for j := range stats.Players {
+			turn.PlayerTicks[j] = -1
+			if i < len(stats.Players[j].TurnTicks) {
+				turn.PlayerTicks[j] = stats.Players[j].TurnTicks[i]
+				if turn.PlayerTicks[j] > last {
+					last = turn.PlayerTicks[j]
+				}
+			}
+		}
+
+		turn.TicksSincePrevious = last - previous
+		previous = last
+	}
+
+	return stats, nil
+}
+
+func main() {
+	flag.Parse()
+
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	if flag.NArg() == 0 {
+		log.Panicf("usage: %s [flags] <replay or directory>...", os.Args[0])
+	}
+
+	replays, err := replay.CollectReplays(flag.Args())
+	if err != nil {
+		log.Panicf("failed to find replays: %s", err)
+	}
+
+	allStats := []*Stats{}
+	for _, path := range replays {
+		stats, err := analyze(path)
+		if err != nil {
+			log.Printf("failed to analyze %s: %s", path, err)
+			continue
+		}
+		allStats = append(allStats, stats)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	if *indent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(allStats); err != nil {
+		log.Panicf("failed to write stats: %s", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/replay"
+)
+
+var (
+	keepBackup = flag.Bool("keep_backup", true, "keep the original file next to the upgraded one, with the old version in its name")
+	dryRun     = flag.Bool("dry_run", false, "only report which replays would be upgraded")
+)
+
+func readVersion(path string) (uint8, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rr, err := replay.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer rr.Close()
+
+	return rr.Version(), nil
+}
+
+func upgrade(path string, info os.FileInfo, version uint8) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r, err := replay.Unmarshal(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if r.Metadata.StartTime.IsZero() {
+		// Replays from before the metadata header don't know when they were recorded, so keep the best guess we have before rewriting the file changes it.
+		r.Metadata.StartTime = info.ModTime()
+	}
+
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if err := replay.Marshal(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if *keepBackup {
+		if err := os.Rename(path, fmt.Sprintf("%s.v%02x.bak", path, version)); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+func main() {
+	flag.Parse()
+
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	if flag.NArg() == 0 {
+		log.Panicf("usage: %s [flags] <replay or directory>...", os.Args[0])
+	}
+
+	replays, err := replay.CollectReplays(flag.Args())
+	if err != nil {
+		log.Panicf("failed to find replays: %s", err)
+	}
+
+	failed := 0
+	for _, path := range replays {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Panicf("failed to stat %s: %s", path, err)
+		}
+
+		version, err := readVersion(path)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stdout, "FAIL     %s: %s\n", path, err)
+			continue
+		}
+
+		if version == replay.CurrentVersion {
+			fmt.Fprintf(os.Stdout, "current  %s\n", path)
+			continue
+		}
+
+		if *dryRun {
+			fmt.Fprintf(os.Stdout, "would upgrade %s (%02x -> %02x)\n", path, version, replay.CurrentVersion)
+			continue
+		}
+
+		if err := upgrade(path, info, version); err != nil {
+			failed++
+			fmt.Fprintf(os.Stdout, "FAIL     %s: %s\n", path, err)
+			continue
+		}
+
+		fmt.Fprintf(os.Stdout, "upgraded %s (%02x -> %02x)\n", path, version, replay.CurrentVersion)
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
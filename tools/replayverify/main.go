@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/murkland/tango/game"
+	"github.com/murkland/tango/input"
+	"github.com/murkland/tango/mgba"
+	"github.com/murkland/tango/replay"
+)
+
+var (
+	romPath      = flag.String("rom_path", "bn6.gba", "path to rom")
+	contextTicks = flag.Int("context", 5, "number of inputs to show on either side of a divergence")
+	maxStall     = flag.Int("max_stall_frames", 60*60, "number of frames to run without consuming an input before giving up")
+)
+
+type verifyError struct {
+	index    int
+	tick     int
+	expected uint32
+	actual   uint32
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("rng diverged at tick %d (input %d): expected %08x, got %08x", e.tick, e.index, e.expected, e.actual)
+}
+
+func formatInputPair(ip [2]input.Input, rngState uint32) string {
+	s := fmt.Sprintf("%d: rngstate=%08x p1joyflags=%04x p2joyflags=%04x p1custstate=%d p2custstate=%d", ip[0].LocalTick, rngState, ip[0].Joyflags, ip[1].Joyflags, ip[0].CustomScreenState, ip[1].CustomScreenState)
+	if ip[0].Turn != nil {
+		s += " +p1 turn"
+	}
+	if ip[1].Turn != nil {
+		s += " +p2 turn"
+	}
+	return s
+}
+
+func verify(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	replayer, err := game.NewReplayer(*romPath, f)
+	if err != nil {
+		return 0, err
+	}
+	defer replayer.Close()
+	// Verifying never seeks, so snapshots would only use up memory.
+	replayer.SetSnapshotInterval(0)
+	core := replayer.Core()
+	defer core.Close()
+
+	metadata := replayer.Metadata()
+	if metadata.ROMTitle != core.GameTitle() || metadata.ROMCRC32 != core.CRC32() {
+		return 0, fmt.Errorf("replay is for %s (%08x), not %s (%08x)", metadata.ROMTitle, metadata.ROMCRC32, core.GameTitle(), core.CRC32())
+	}
+
+	var verr *verifyError
+	checked := 0
+	replayer.SetInputCallback(func(tick replay.Tick) {
+		i := checked
+		checked++
+		if verr != nil {
+			return
+		}
+		if actual := replayer.BN6().RNG2State(core); actual != tick.RNGState {
+			verr = &verifyError{i, tick.InputPair[0].LocalTick, tick.RNGState, actual}
+		}
+	})
+
+	ended := false
+	replayer.SetEndedCallback(func() {
+		ended = true
+	})
+	replayer.Reset()
+
+	total := replayer.LastTick() - replayer.FirstTick()
+
+	stalled := 0
+	for !ended && verr == nil {
+		lastChecked := checked
+		core.RunFrame()
+		if checked == lastChecked {
+			stalled++
+			if stalled > *maxStall {
+				return checked, fmt.Errorf("stalled after %d of %d inputs", checked, total)
+			}
+		} else {
+			stalled = 0
+		}
+	}
+
+	if err := replayer.Err(); err != nil {
+		return checked, err
+	}
+
+	if verr != nil {
+		return checked, verr
+	}
+
+	if checked != total {
+		return checked, fmt.Errorf("battle ended after %d of %d inputs", checked, total)
+	}
+
+	return checked, nil
+}
+
+// printContext prints the inputs around a divergence, reading the replay again so none of it has to be kept around while verifying.
+func printContext(path string, verr *verifyError) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rr, err := replay.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer rr.Close()
+
+	start := verr.index - *contextTicks
+	end := verr.index + *contextTicks + 1
+	for i := 0; i < end; i++ {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		if i < start {
+			continue
+		}
+		marker := " "
+		if i == verr.index {
+			marker = ">"
+		}
+		fmt.Fprintf(os.Stdout, "  %s %s\n", marker, formatInputPair(tick.InputPair, tick.RNGState))
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	if flag.NArg() == 0 {
+		log.Panicf("usage: %s [flags] <replay or directory>...", os.Args[0])
+	}
+
+	replays, err := replay.CollectReplays(flag.Args())
+	if err != nil {
+		log.Panicf("failed to find replays: %s", err)
+	}
+
+	failed := 0
+	for _, path := range replays {
+		checked, err := verify(path)
+		if err == nil {
+			fmt.Fprintf(os.Stdout, "ok    %s (%d ticks)\n", path, checked)
+			continue
+		}
+
+		failed++
+		fmt.Fprintf(os.Stdout, "FAIL  %s: %s\n", path, err)
+
+		var verr *verifyError
+		if !errors.As(err, &verr) {
+			continue
+		}
+
+		if err := printContext(path, verr); err != nil {
+			fmt.Fprintf(os.Stdout, "  failed to read inputs around divergence: %s\n", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "%d/%d replays verified\n", len(replays)-failed, len(replays))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
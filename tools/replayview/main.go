@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"image"
+	"image/color"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,33 +15,153 @@ import (
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/audio"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
 	"github.com/murkland/tango/av"
 	"github.com/murkland/tango/game"
+	"github.com/murkland/tango/input"
 	"github.com/murkland/tango/mgba"
 	"github.com/murkland/tango/replay"
+	"github.com/murkland/tango/tools/replaylib/queryflags"
 	"github.com/ncruces/zenity"
 )
 
 var (
-	romPath = flag.String("rom_path", "bn6.gba", "path to rom")
+	romPath    = flag.String("rom_path", "bn6.gba", "path to rom")
+	replaysDir = flag.String("replays_dir", "replays", "path to replays directory to browse")
+
+	showInputDisplay = flag.Bool("input_display", false, "show the input display overlay (toggle with F3)")
+	snapshotInterval = flag.Int("snapshot_interval", game.DefaultSnapshotInterval, "ticks between in-memory snapshots taken while playing, for seeking backwards")
+
+	libraryQuery replay.LibraryQuery
 )
 
+func init() {
+	queryflags.Bind(flag.CommandLine, &libraryQuery)
+}
+
+const browseOption = "Browse..."
+
+func selectReplay() (string, error) {
+	lib, err := replay.OpenLibrary(*replaysDir)
+	if err != nil {
+		log.Printf("failed to open replay library, falling back to file picker: %s", err)
+		return zenity.SelectFile(zenity.Title("Select a replay to watch"))
+	}
+
+	entries := lib.Query(libraryQuery)
+	options := make([]string, 0, len(entries)+1)
+	paths := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		option := fmt.Sprintf("%s  %s  p%d  %s  %s  (%s)", entry.Date.Format("2006-01-02 15:04"), entry.ROMTitle, entry.LocalPlayerIndex+1, entry.Duration(), entry.Result, entry.Filename)
+		options = append(options, option)
+		paths[option] = lib.Path(entry)
+	}
+	options = append(options, browseOption)
+
+	option, err := zenity.List("Select a replay to watch", options, zenity.Title("tango replayview"))
+	if err != nil {
+		return "", err
+	}
+
+	if option == browseOption {
+		return zenity.SelectFile(zenity.Title("Select a replay to watch"), zenity.Filename(lib.Dir()+string(filepath.Separator)))
+	}
+
+	return paths[option], nil
+}
+
+// openReplay opens either a single battle replay or a whole match. The battles are read from the file as they play, so it must stay open.
+func openReplay(path string) ([]*io.SectionReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if filepath.Ext(path) != ".tangomatch" {
+		return []*io.SectionReader{io.NewSectionReader(f, 0, info.Size())}, nil
+	}
+
+	m, err := replay.OpenMatch(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if len(m.Battles) == 0 {
+		f.Close()
+		return nil, errors.New("match has no battles")
+	}
+	return m.Battles, nil
+}
+
+// readInputPairs reads the inputs of a battle for the input display. Turns and keyframes are left out, since the input display doesn't need them.
+func readInputPairs(battle *io.SectionReader) ([][2]input.Input, error) {
+	// A separate section reader, so this doesn't move the replayer's place in the file.
+	rr, err := replay.NewReader(io.NewSectionReader(battle, 0, battle.Size()))
+	if err != nil {
+		return nil, err
+	}
+	defer rr.Close()
+
+	var inputPairs [][2]input.Input
+	for {
+		tick, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		ip := tick.InputPair
+		ip[0].Turn = nil
+		ip[1].Turn = nil
+		inputPairs = append(inputPairs, ip)
+	}
+	return inputPairs, nil
+}
+
 type Game struct {
 	replayer *game.Replayer
 
+	// battles has more than one replay if a whole match is being played.
+	battles []*io.SectionReader
+	battle  int
+
 	vb      *av.VideoBuffer
 	vbPixMu sync.Mutex
 	vbPix   []byte
+	tick    int
+	// battleEnded is set from the mgba thread when a battle of a match finishes, so the next one can be loaded.
+	battleEnded bool
+
+	paused    bool
+	turnTicks []int
+
+	inputPairs       [][2]input.Input
+	inputDisplay     *game.InputDisplay
+	inputDisplayTick int
+	showInputDisplay bool
 
 	fbuf *ebiten.Image
 
+	// screenWidth and screenHeight are the size of the screen as last laid out.
+	screenWidth  int
+	screenHeight int
+
 	gameAudioPlayer *audio.Player
 
 	t *mgba.Thread
 }
 
 func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
+	g.screenWidth, g.screenHeight = outsideWidth, outsideHeight
 	return outsideWidth, outsideHeight
 }
 
@@ -49,6 +171,25 @@ func (g *Game) Update() error {
 	}
 	g.gameAudioPlayer.Play()
 
+	if g.consumeBattleEnded() {
+		if err := g.loadBattle((g.battle + 1) % len(g.battles)); err != nil {
+			return err
+		}
+	}
+
+	if err := g.updateTransport(); err != nil {
+		return err
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyF3) {
+		g.showInputDisplay = !g.showInputDisplay
+	}
+
+	if tick := g.currentTick(); g.showInputDisplay && tick != g.inputDisplayTick {
+		g.inputDisplay.LoadReplay(g.inputPairs, tick-g.replayer.FirstTick())
+		g.inputDisplayTick = tick
+	}
+
 	fpsTarget := g.replayer.Core().GBA().Sync().FPSTarget()
 	if inpututil.IsKeyJustPressed(ebiten.KeyEqual) {
 		g.replayer.Core().GBA().Sync().SetFPSTarget(fpsTarget + 10)
@@ -60,6 +201,181 @@ func (g *Game) Update() error {
 	return nil
 }
 
+// withCore runs f with the mgba thread paused, then shows the frame it left off on.
+func (g *Game) withCore(f func()) {
+	if !g.paused {
+		g.t.Pause()
+		defer g.t.Unpause()
+	}
+
+	f()
+
+	g.vbPixMu.Lock()
+	defer g.vbPixMu.Unlock()
+	copy(g.vbPix, g.vb.Pix())
+	g.tick = g.replayer.Tick()
+}
+
+func (g *Game) consumeBattleEnded() bool {
+	g.vbPixMu.Lock()
+	defer g.vbPixMu.Unlock()
+	battleEnded := g.battleEnded
+	g.battleEnded = false
+	return battleEnded
+}
+
+func (g *Game) loadBattle(i int) error {
+	inputPairs, err := readInputPairs(g.battles[i])
+	if err != nil {
+		return err
+	}
+
+	g.withCore(func() {
+		err = g.replayer.Load(g.battles[i])
+
+		g.vbPixMu.Lock()
+		defer g.vbPixMu.Unlock()
+		g.battleEnded = false
+	})
+	if err != nil {
+		return err
+	}
+
+	g.battle = i
+	g.turnTicks = g.replayer.TurnTicks()
+	g.inputPairs = inputPairs
+	g.inputDisplayTick = -1
+	return nil
+}
+
+func (g *Game) seek(tick int) {
+	g.withCore(func() {
+		g.replayer.Seek(tick)
+	})
+}
+
+func (g *Game) currentTick() int {
+	g.vbPixMu.Lock()
+	defer g.vbPixMu.Unlock()
+	return g.tick
+}
+
+func (g *Game) setPaused(paused bool) {
+	if paused == g.paused {
+		return
+	}
+	g.paused = paused
+	if paused {
+		g.t.Pause()
+	} else {
+		g.t.Unpause()
+	}
+}
+
+func (g *Game) updateTransport() error {
+	if inpututil.IsKeyJustPressed(ebiten.KeySpace) {
+		g.setPaused(!g.paused)
+	}
+
+	// Frame stepping always pauses.
+	if inpututil.IsKeyJustPressed(ebiten.KeyPeriod) {
+		g.setPaused(true)
+		g.withCore(g.replayer.Step)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyComma) {
+		g.setPaused(true)
+		g.withCore(g.replayer.StepBack)
+	}
+
+	// Holding R rewinds at normal speed.
+	if ebiten.IsKeyPressed(ebiten.KeyR) {
+		g.withCore(g.replayer.StepBack)
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyArrowLeft) {
+		g.seek(g.currentTick() - expectedFPS)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyArrowRight) {
+		g.seek(g.currentTick() + expectedFPS)
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyBracketLeft) {
+		tick := g.currentTick()
+		for i := len(g.turnTicks) - 1; i >= 0; i-- {
+			// Skip over the turn we're currently on, otherwise we could never go back past it.
+			if g.turnTicks[i] < tick-1 {
+				g.seek(g.turnTicks[i] + 1)
+				break
+			}
+		}
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyBracketRight) {
+		tick := g.currentTick()
+		for _, turnTick := range g.turnTicks {
+			if turnTick >= tick {
+				g.seek(turnTick + 1)
+				break
+			}
+		}
+	}
+
+	if len(g.battles) > 1 {
+		if inpututil.IsKeyJustPressed(ebiten.KeyPageUp) && g.battle > 0 {
+			if err := g.loadBattle(g.battle - 1); err != nil {
+				return err
+			}
+		}
+		if inpututil.IsKeyJustPressed(ebiten.KeyPageDown) && g.battle < len(g.battles)-1 {
+			if err := g.loadBattle(g.battle + 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ebiten.IsMouseButtonPressed(ebiten.MouseButtonLeft) {
+		// The cursor position is in the same coordinates as the screen the seek bar is drawn on.
+		x, y := ebiten.CursorPosition()
+		w, h := g.screenWidth, g.screenHeight
+		if y >= h-seekBarHeight && w > 0 {
+			first := g.replayer.FirstTick()
+			tick := first + x*(g.replayer.LastTick()-first)/w
+			if tick != g.currentTick() {
+				g.seek(tick)
+			}
+		}
+	}
+
+	return nil
+}
+
+const seekBarHeight = 8
+
+func (g *Game) drawSeekBar(screen *ebiten.Image, tick int) {
+	w := float64(screen.Bounds().Dx())
+	y := float64(screen.Bounds().Dy() - seekBarHeight)
+
+	first := g.replayer.FirstTick()
+	length := float64(g.replayer.LastTick() - first)
+	if length <= 0 {
+		return
+	}
+
+	ebitenutil.DrawRect(screen, 0, y, w, seekBarHeight, color.RGBA{0x40, 0x40, 0x40, 0xc0})
+	ebitenutil.DrawRect(screen, 0, y, w*float64(tick-first)/length, seekBarHeight, color.RGBA{0xff, 0xff, 0xff, 0xc0})
+	for _, turnTick := range g.turnTicks {
+		ebitenutil.DrawRect(screen, w*float64(turnTick-first)/length, y, 1, seekBarHeight, color.RGBA{0xff, 0x00, 0xff, 0xff})
+	}
+
+	status := fmt.Sprintf("tick %d/%d", tick, g.replayer.LastTick())
+	if len(g.battles) > 1 {
+		status = fmt.Sprintf("battle %d/%d, %s", g.battle+1, len(g.battles), status)
+	}
+	if g.paused {
+		status += " (paused)"
+	}
+	ebitenutil.DebugPrintAt(screen, status, 2, int(y)-16)
+}
+
 func (g *Game) scaleFactor(bounds image.Rectangle) int {
 	w, h := g.replayer.Core().DesiredVideoDimensions()
 	k := bounds.Dx() / w
@@ -80,6 +396,12 @@ func (g *Game) Draw(screen *ebiten.Image) {
 	opts.GeoM.Translate(float64((screen.Bounds().Dx()-w*k)/2), float64((screen.Bounds().Dy()-h*k)/2))
 	g.fbuf.ReplacePixels(g.vbPix)
 	screen.DrawImage(ebiten.NewImageFromImage(g.fbuf), opts)
+
+	if g.showInputDisplay {
+		g.inputDisplay.Draw(screen)
+	}
+
+	g.drawSeekBar(screen, g.tick)
 }
 
 const expectedFPS = 60
@@ -96,23 +418,29 @@ func main() {
 
 	replayName := flag.Arg(0)
 	if replayName == "" {
-		fn, err := zenity.SelectFile(zenity.Title("Select a replay to watch"))
+		fn, err := selectReplay()
 		if err != nil {
 			log.Panicf("failed to prompt for replay: %s", err)
 		}
 		replayName = fn
 	}
 
-	f, err := os.Open(replayName)
+	battles, err := openReplay(replayName)
 	if err != nil {
 		log.Panicf("failed to open replay: %s", err)
 	}
-	defer f.Close()
 
-	r, err := replay.Unmarshal(f)
+	rr, err := replay.NewReader(io.NewSectionReader(battles[0], 0, battles[0].Size()))
 	if err != nil {
 		log.Panicf("failed to open replay: %s", err)
 	}
+	state := rr.State()
+	rr.Close()
+
+	inputPairs, err := readInputPairs(battles[0])
+	if err != nil {
+		log.Panicf("failed to read replay inputs: %s", err)
+	}
 
 	roms, err := os.ReadDir("roms")
 	if err != nil {
@@ -142,12 +470,12 @@ func main() {
 				return err
 			}
 
-			if r.State.ROMTitle != core.GameTitle() {
-				return fmt.Errorf("rom title doesn't match: %s != %s", r.State.ROMTitle, core.GameTitle())
+			if state.ROMTitle != core.GameTitle() {
+				return fmt.Errorf("rom title doesn't match: %s != %s", state.ROMTitle, core.GameTitle())
 			}
 
-			if r.State.ROMCRC32 != core.CRC32() {
-				return fmt.Errorf("crc32 doesn't match: %08x != %08x", r.State.ROMCRC32, core.CRC32())
+			if state.ROMCRC32 != core.CRC32() {
+				return fmt.Errorf("crc32 doesn't match: %08x != %08x", state.ROMCRC32, core.CRC32())
 			}
 
 			return nil
@@ -164,11 +492,13 @@ func main() {
 		log.Panicf("failed find eligible rom")
 	}
 
-	replayer, err := game.NewReplayer(romPath, r)
+	replayer, err := game.NewReplayer(romPath, battles[0])
 	if err != nil {
 		log.Panicf("failed to make replayer: %s", err)
 	}
 
+	replayer.SetSnapshotInterval(*snapshotInterval)
+
 	audioCtx := audio.NewContext(replayer.Core().Options().SampleRate)
 
 	width, height := replayer.Core().DesiredVideoDimensions()
@@ -186,10 +516,26 @@ func main() {
 
 	g := &Game{
 		replayer:        replayer,
+		battles:         battles,
 		vb:              vb,
 		vbPix:           make([]byte, width*height*4),
 		fbuf:            ebiten.NewImage(width, height),
 		gameAudioPlayer: gameAudioPlayer,
+		turnTicks:       replayer.TurnTicks(),
+
+		inputPairs:       inputPairs,
+		inputDisplay:     game.NewInputDisplay(),
+		inputDisplayTick: -1,
+		showInputDisplay: *showInputDisplay,
+	}
+
+	// Play a whole match straight through, going back to the first battle after the last.
+	if len(battles) > 1 {
+		replayer.SetEndedCallback(func() {
+			g.vbPixMu.Lock()
+			defer g.vbPixMu.Unlock()
+			g.battleEnded = true
+		})
 	}
 
 	g.t = mgba.NewThread(replayer.Core())
@@ -197,6 +543,7 @@ func main() {
 		g.vbPixMu.Lock()
 		defer g.vbPixMu.Unlock()
 		copy(g.vbPix, g.vb.Pix())
+		g.tick = g.replayer.Tick()
 	})
 
 	if !g.t.Start() {
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/murkland/tango/bn6"
+	"github.com/murkland/tango/mgba"
+)
+
+var (
+	romPath   = flag.String("rom_path", "bn6.gba", "path to rom")
+	statePath = flag.String("state", "", "path to a savestate to load after the rom")
+)
+
+const helpText = `commands:
+  b <addr>                  stop before a thumb instruction runs
+  barm <addr>               stop before an arm instruction runs
+  watch <addr> [size] [r|w|rw]
+                            stop after memory in [addr, addr+size) is accessed (default: 4 bytes, writes)
+  l                         list breakpoints and watchpoints
+  d <id>                    delete a breakpoint or watchpoint
+  disable <id>              disable a breakpoint
+  enable <id>               re-enable a breakpoint
+  s [n]                     step n instructions (default: 1)
+  c                         continue until a breakpoint or watchpoint is hit (ctrl-c to interrupt)
+  f [n]                     run n whole frames (default: 1), reporting breakpoints hit along the way
+  r                         dump registers
+  setreg <reg> <value>      set a register
+  x <addr> [len]            dump memory (default: 64 bytes)
+  w8|w16|w32 <addr> <value> write memory
+  dis [addr] [n]            disassemble n thumb instructions around addr (default: around the pc)
+  state                     dump the game's known EWRAM structs (bn6 only)
+  savestate <path>          save the current state
+  loadstate <path>          load a state
+  q                         quit
+`
+
+type breakpoint struct {
+	addr uint32
+	arm  bool
+	trap *mgba.Trap
+}
+
+type watchpoint struct {
+	addr uint32
+	size int
+	kind mgba.WatchKind
+	wp   *mgba.Watchpoint
+}
+
+type debugger struct {
+	core    *mgba.Core
+	bn6     *bn6.BN6
+	trapper *mgba.Trapper
+	watcher *mgba.Watcher
+
+	nextID      int
+	breakpoints map[int]*breakpoint
+	watchpoints map[int]*watchpoint
+
+	// stopReason is set by breakpoint and watchpoint handlers while running.
+	stopReason string
+
+	// resuming is set while the first instruction after a stop runs, so the breakpoint that was stopped at doesn't stop it again.
+	resuming bool
+	// runningFrames is set while running whole frames, where breakpoints are only reported, since a frame can't be stopped partway through.
+	runningFrames bool
+
+	interrupted int32
+}
+
+func newDebugger(core *mgba.Core) *debugger {
+	d := &debugger{
+		core:        core,
+		bn6:         bn6.Load(core.GameTitle()),
+		trapper:     mgba.NewTrapper(core),
+		watcher:     mgba.NewWatcher(core),
+		nextID:      1,
+		breakpoints: map[int]*breakpoint{},
+		watchpoints: map[int]*watchpoint{},
+	}
+	d.trapper.Attach(core.GBA())
+	d.trapper.SetBeforeHook(d.beforeTrap)
+	d.watcher.Attach(core.GBA())
+	return d
+}
+
+// pc returns the address of the next instruction to be executed.
+func (d *debugger) pc() uint32 {
+	const wordSizeThumb = 2
+	const wordSizeARM = 4
+
+	if d.core.GBA().ThumbMode() {
+		return d.core.GBA().Register(15) - wordSizeThumb
+	}
+	return d.core.GBA().Register(15) - wordSizeARM
+}
+
+func (d *debugger) addBreakpoint(addr uint32, arm bool) int {
+	id := d.nextID
+	d.nextID++
+
+	// Breakpoints stop from beforeTrap, before the instruction runs, so the trap itself has nothing left to do.
+	handler := func() {}
+
+	bp := &breakpoint{addr: addr, arm: arm}
+	if arm {
+		bp.trap = d.trapper.AddARM(addr, 0, handler)
+	} else {
+		bp.trap = d.trapper.Add(addr, handler)
+	}
+	d.breakpoints[id] = bp
+	return id
+}
+
+// beforeTrap stops the CPU on an enabled breakpoint before its instruction runs.
+func (d *debugger) beforeTrap(addr uint32) bool {
+	if d.resuming {
+		return false
+	}
+
+	for id, bp := range d.breakpoints {
+		if bp.addr != addr || !bp.trap.Enabled() {
+			continue
+		}
+		d.stopReason = fmt.Sprintf("breakpoint %d hit at 0x%08x", id, addr)
+		return !d.runningFrames
+	}
+	return false
+}
+
+// resume runs the instruction the CPU is stopped at, even if it has a breakpoint on it.
+func (d *debugger) resume() {
+	d.resuming = true
+	d.core.GBA().Step()
+	d.resuming = false
+}
+
+func (d *debugger) addWatchpoint(addr uint32, size int, kind mgba.WatchKind) int {
+	id := d.nextID
+	d.nextID++
+
+	wp := &watchpoint{addr: addr, size: size, kind: kind}
+	wp.wp = d.watcher.Add(addr, size, kind, func(ev mgba.WatchEvent) {
+		kind := "read"
+		if ev.Kind == mgba.WatchWrite {
+			kind = "write"
+		}
+		d.stopReason = fmt.Sprintf("watchpoint %d: %s of %d bytes at 0x%08x from pc=0x%08x: 0x%x -> 0x%x", id, kind, ev.Width, ev.Address, ev.PC, ev.OldValue, ev.NewValue)
+	})
+	d.watchpoints[id] = wp
+	return id
+}
+
+func (d *debugger) remove(id int) error {
+	if bp, ok := d.breakpoints[id]; ok {
+		bp.trap.Remove()
+		delete(d.breakpoints, id)
+		return nil
+	}
+	if wp, ok := d.watchpoints[id]; ok {
+		wp.wp.Remove()
+		delete(d.watchpoints, id)
+		return nil
+	}
+	return fmt.Errorf("no breakpoint or watchpoint %d", id)
+}
+
+func (d *debugger) list() {
+	ids := make([]int, 0, len(d.breakpoints)+len(d.watchpoints))
+	for id := range d.breakpoints {
+		ids = append(ids, id)
+	}
+	for id := range d.watchpoints {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if bp, ok := d.breakpoints[id]; ok {
+			mode := "thumb"
+			if bp.arm {
+				mode = "arm"
+			}
+			enabled := ""
+			if !bp.trap.Enabled() {
+				enabled = " (disabled)"
+			}
+			fmt.Printf("%3d  break  0x%08x %s%s\n", id, bp.addr, mode, enabled)
+			continue
+		}
+		wp := d.watchpoints[id]
+		kind := ""
+		if wp.kind&mgba.WatchRead != 0 {
+			kind += "r"
+		}
+		if wp.kind&mgba.WatchWrite != 0 {
+			kind += "w"
+		}
+		fmt.Printf("%3d  watch  0x%08x+%d %s\n", id, wp.addr, wp.size, kind)
+	}
+}
+
+// step runs up to n instructions, stopping early if a breakpoint or watchpoint is hit.
+func (d *debugger) step(n int) {
+	d.stopReason = ""
+	if n > 0 {
+		d.resume()
+	}
+	for i := 1; i < n && d.stopReason == ""; i++ {
+		d.core.GBA().Step()
+	}
+	if d.stopReason != "" {
+		fmt.Println(d.stopReason)
+	}
+}
+
+func (d *debugger) cont() {
+	d.stopReason = ""
+	atomic.StoreInt32(&d.interrupted, 0)
+	d.resume()
+	for d.stopReason == "" {
+		// Only check for ctrl-c every so often, it's expensive compared to a single instruction.
+		for i := 0; i < 0x1000 && d.stopReason == ""; i++ {
+			d.core.GBA().Step()
+		}
+		if atomic.LoadInt32(&d.interrupted) != 0 {
+			d.stopReason = "interrupted"
+		}
+	}
+	fmt.Println(d.stopReason)
+}
+
+func (d *debugger) frames(n int) {
+	d.runningFrames = true
+	defer func() { d.runningFrames = false }()
+
+	for i := 0; i < n; i++ {
+		d.stopReason = ""
+		d.core.RunFrame()
+		if d.stopReason != "" {
+			fmt.Printf("frame %d: %s\n", d.core.FrameCounter(), d.stopReason)
+		}
+	}
+}
+
+func (d *debugger) dumpRegisters() {
+	gba := d.core.GBA()
+	for i := 0; i < 16; i++ {
+		v := gba.Register(i)
+		if i == 15 {
+			v = d.pc()
+		}
+		fmt.Printf("%-3s %08x", thumbRegNames[i], v)
+		if i%4 == 3 {
+			fmt.Println()
+		} else {
+			fmt.Print("  ")
+		}
+	}
+
+	cpsrBytes := gba.CPSR()
+	cpsr := binary.LittleEndian.Uint32(cpsrBytes[:])
+	flags := []byte("nzcv")
+	for i, bit := range []uint32{31, 30, 29, 28} {
+		if cpsr&(1<<bit) != 0 {
+			flags[i] -= 'a' - 'A'
+		}
+	}
+	mode := "arm"
+	if gba.ThumbMode() {
+		mode = "thumb"
+	}
+	fmt.Printf("cpsr %08x  %s  mode=%02x  %s\n", cpsr, flags, cpsr&0x1f, mode)
+}
+
+func (d *debugger) setRegister(name string, v uint32) error {
+	for i, regName := range thumbRegNames {
+		if name != regName && name != fmt.Sprintf("r%d", i) {
+			continue
+		}
+		if i == 15 && !d.core.GBA().ThumbMode() {
+			return errors.New("setting the pc is only supported in thumb mode")
+		}
+		d.core.GBA().SetRegister(i, v)
+		if i == 15 {
+			d.core.GBA().ThumbWritePC()
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown register: %s", name)
+}
+
+func (d *debugger) dumpMemory(addr uint32, n int) {
+	buf := make([]byte, n)
+	d.core.RawReadRange(addr, -1, buf)
+
+	for i := 0; i < len(buf); i += 16 {
+		end := i + 16
+		if end > len(buf) {
+			end = len(buf)
+		}
+		row := buf[i:end]
+
+		var hex strings.Builder
+		var ascii strings.Builder
+		for _, b := range row {
+			fmt.Fprintf(&hex, "%02x ", b)
+			if b >= 0x20 && b < 0x7f {
+				ascii.WriteByte(b)
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+		fmt.Printf("%08x  %-48s %s\n", addr+uint32(i), hex.String(), ascii.String())
+	}
+}
+
+// read16 reads a halfword of code, with any breakpoint the trapper patched over it replaced by the original instruction.
+func (d *debugger) read16(addr uint32) uint16 {
+	if original, ok := d.trapper.Original(addr); ok {
+		return uint16(original)
+	}
+	for _, bp := range d.breakpoints {
+		if !bp.arm || bp.addr+2 != addr {
+			continue
+		}
+		if original, ok := d.trapper.Original(bp.addr); ok {
+			return uint16(original >> 16)
+		}
+	}
+	return d.core.RawRead16(addr, -1)
+}
+
+func (d *debugger) disassemble(addr uint32, n int) {
+	pc := d.pc()
+	breakpointAddrs := map[uint32]bool{}
+	for _, bp := range d.breakpoints {
+		breakpointAddrs[bp.addr] = true
+	}
+
+	for i := 0; i < n; i++ {
+		op := d.read16(addr)
+		next := d.read16(addr + 2)
+		text, size := disassembleThumb(addr, op, next)
+
+		marker := "  "
+		if addr == pc {
+			marker = "=>"
+		}
+		bpMarker := " "
+		if breakpointAddrs[addr] {
+			bpMarker = "*"
+		}
+
+		raw := fmt.Sprintf("%04x", op)
+		if size == 4 {
+			raw += fmt.Sprintf(" %04x", next)
+		}
+		fmt.Printf("%s%s %08x  %-9s  %s\n", marker, bpMarker, addr, raw, text)
+		addr += uint32(size)
+	}
+}
+
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(v), nil
+}
+
+func parseInt(args []string, i int, def int) (int, error) {
+	if len(args) <= i {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(args[i], 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(v), nil
+}
+
+func (d *debugger) exec(args []string) error {
+	var err error
+
+	switch args[0] {
+	case "help", "h", "?":
+		fmt.Print(helpText)
+
+	case "b", "barm":
+		if len(args) < 2 {
+			return errors.New("usage: b <addr>")
+		}
+		addr, err := parseUint32(args[1])
+		if err != nil {
+			return err
+		}
+		id := d.addBreakpoint(addr, args[0] == "barm")
+		fmt.Printf("breakpoint %d at 0x%08x\n", id, addr)
+
+	case "watch":
+		if len(args) < 2 {
+			return errors.New("usage: watch <addr> [size] [r|w|rw]")
+		}
+		addr, err := parseUint32(args[1])
+		if err != nil {
+			return err
+		}
+		size, err := parseInt(args, 2, 4)
+		if err != nil {
+			return err
+		}
+		kind := mgba.WatchWrite
+		if len(args) > 3 {
+			switch args[3] {
+			case "r":
+				kind = mgba.WatchRead
+			case "w":
+				kind = mgba.WatchWrite
+			case "rw":
+				kind = mgba.WatchReadWrite
+			default:
+				return fmt.Errorf("unknown watch kind: %s", args[3])
+			}
+		}
+		id := d.addWatchpoint(addr, size, kind)
+		fmt.Printf("watchpoint %d at 0x%08x+%d\n", id, addr, size)
+
+	case "l":
+		d.list()
+
+	case "d", "disable", "enable":
+		id, err := parseInt(args, 1, -1)
+		if err != nil {
+			return err
+		}
+		if args[0] == "d" {
+			return d.remove(id)
+		}
+		bp, ok := d.breakpoints[id]
+		if !ok {
+			return fmt.Errorf("no breakpoint %d", id)
+		}
+		if args[0] == "enable" {
+			bp.trap.Enable()
+		} else {
+			bp.trap.Disable()
+		}
+
+	case "s":
+		n, err := parseInt(args, 1, 1)
+		if err != nil {
+			return err
+		}
+		d.step(n)
+		d.disassemble(d.pc(), 1)
+
+	case "c":
+		d.cont()
+		d.disassemble(d.pc(), 1)
+
+	case "f":
+		n, err := parseInt(args, 1, 1)
+		if err != nil {
+			return err
+		}
+		d.frames(n)
+
+	case "r":
+		d.dumpRegisters()
+
+	case "setreg":
+		if len(args) < 3 {
+			return errors.New("usage: setreg <reg> <value>")
+		}
+		v, err := parseUint32(args[2])
+		if err != nil {
+			return err
+		}
+		return d.setRegister(args[1], v)
+
+	case "x":
+		if len(args) < 2 {
+			return errors.New("usage: x <addr> [len]")
+		}
+		addr, err := parseUint32(args[1])
+		if err != nil {
+			return err
+		}
+		n, err := parseInt(args, 2, 64)
+		if err != nil {
+			return err
+		}
+		d.dumpMemory(addr, n)
+
+	case "w8", "w16", "w32":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: %s <addr> <value>", args[0])
+		}
+		addr, err := parseUint32(args[1])
+		if err != nil {
+			return err
+		}
+		v, err := parseUint32(args[2])
+		if err != nil {
+			return err
+		}
+		switch args[0] {
+		case "w8":
+			d.core.RawWrite8(addr, -1, uint8(v))
+		case "w16":
+			d.core.RawWrite16(addr, -1, uint16(v))
+		case "w32":
+			d.core.RawWrite32(addr, -1, v)
+		}
+
+	case "dis":
+		addr := d.pc() - 8
+		if len(args) > 1 {
+			if addr, err = parseUint32(args[1]); err != nil {
+				return err
+			}
+		}
+		n, err := parseInt(args, 2, 12)
+		if err != nil {
+			return err
+		}
+		if !d.core.GBA().ThumbMode() && len(args) == 1 {
+			fmt.Println("note: the cpu is in arm mode, only thumb can be disassembled")
+		}
+		d.disassemble(addr&^1, n)
+
+	case "state":
+		if d.bn6 == nil {
+			return errors.New("struct layouts are not known for this game")
+		}
+		fmt.Print(d.bn6.DumpState(d.core))
+
+	case "savestate":
+		if len(args) < 2 {
+			return errors.New("usage: savestate <path>")
+		}
+		state := d.core.SaveState()
+		if state == nil {
+			return errors.New("failed to save state")
+		}
+		return os.WriteFile(args[1], state.Bytes(), 0o644)
+
+	case "loadstate":
+		if len(args) < 2 {
+			return errors.New("usage: loadstate <path>")
+		}
+		return d.loadState(args[1])
+
+	default:
+		return fmt.Errorf("unknown command: %s (try help)", args[0])
+	}
+
+	return nil
+}
+
+func (d *debugger) loadState(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !d.core.LoadState(mgba.StateFromBytes(raw)) {
+		return errors.New("failed to load state")
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	mgba.SetDefaultLogger(func(category string, level int, message string) {
+		if level&0x7 == 0 {
+			return
+		}
+		log.Printf("mgba: level=%d category=%s %s", level, category, message)
+	})
+
+	core, err := mgba.NewGBACore()
+	if err != nil {
+		log.Panicf("failed to create core: %s", err)
+	}
+	defer core.Close()
+
+	vf := mgba.OpenVF(*romPath, os.O_RDONLY)
+	if vf == nil {
+		log.Panicf("failed to open rom")
+	}
+
+	if err := core.LoadROM(vf); err != nil {
+		log.Panicf("failed to load rom: %s", err)
+	}
+
+	core.Config().Init("tango")
+	core.Config().Load()
+
+	d := newDebugger(core)
+	core.Reset()
+
+	if *statePath != "" {
+		if err := d.loadState(*statePath); err != nil {
+			log.Panicf("failed to load state: %s", err)
+		}
+	}
+
+	// ctrl-c interrupts a running continue instead of exiting.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		for range sigCh {
+			atomic.StoreInt32(&d.interrupted, 1)
+		}
+	}()
+
+	fmt.Printf("%s (%08x), type help for commands\n", core.GameTitle(), core.CRC32())
+	d.disassemble(d.pc(), 1)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("(tangodbg) ")
+		if !scanner.Scan() {
+			break
+		}
+
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "q" || args[0] == "quit" {
+			break
+		}
+
+		if err := d.exec(args); err != nil {
+			fmt.Printf("error: %s\n", err)
+		}
+	}
+}
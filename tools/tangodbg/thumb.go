@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var thumbRegNames = [16]string{"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7", "r8", "r9", "r10", "r11", "r12", "sp", "lr", "pc"}
+
+var thumbCondNames = [16]string{"eq", "ne", "cs", "cc", "mi", "pl", "vs", "vc", "hi", "ls", "ge", "lt", "gt", "le", "al", "nv"}
+
+var thumbALUOps = [16]string{"and", "eor", "lsl", "lsr", "asr", "adc", "sbc", "ror", "tst", "neg", "cmp", "cmn", "orr", "mul", "bic", "mvn"}
+
+func thumbRegList(rlist uint16, extra string) string {
+	var regs []string
+	for i := 0; i < 8; i++ {
+		if rlist&(1<<i) != 0 {
+			regs = append(regs, thumbRegNames[i])
+		}
+	}
+	if extra != "" {
+		regs = append(regs, extra)
+	}
+	return "{" + strings.Join(regs, ", ") + "}"
+}
+
+func signExtend(v uint32, bits int) int32 {
+	shift := 32 - bits
+	return int32(v<<shift) >> shift
+}
+
+// disassembleThumb disassembles the instruction at addr. next is the halfword after it, which is only needed for the two halves of bl. It returns how many bytes the instruction took.
+func disassembleThumb(addr uint32, op uint16, next uint16) (string, int) {
+	rd := op & 0x7
+	rs := (op >> 3) & 0x7
+
+	switch {
+	case op&0xf800 == 0x1800:
+		// add/subtract
+		mnemonic := "add"
+		if op&0x0200 != 0 {
+			mnemonic = "sub"
+		}
+		rn := (op >> 6) & 0x7
+		if op&0x0400 != 0 {
+			return fmt.Sprintf("%s %s, %s, #%d", mnemonic, thumbRegNames[rd], thumbRegNames[rs], rn), 2
+		}
+		return fmt.Sprintf("%s %s, %s, %s", mnemonic, thumbRegNames[rd], thumbRegNames[rs], thumbRegNames[rn]), 2
+
+	case op&0xe000 == 0x0000:
+		// move shifted register
+		mnemonic := [3]string{"lsl", "lsr", "asr"}[(op>>11)&0x3]
+		return fmt.Sprintf("%s %s, %s, #%d", mnemonic, thumbRegNames[rd], thumbRegNames[rs], (op>>6)&0x1f), 2
+
+	case op&0xe000 == 0x2000:
+		// move/compare/add/subtract immediate
+		mnemonic := [4]string{"mov", "cmp", "add", "sub"}[(op>>11)&0x3]
+		return fmt.Sprintf("%s %s, #0x%02x", mnemonic, thumbRegNames[(op>>8)&0x7], op&0xff), 2
+
+	case op&0xfc00 == 0x4000:
+		// alu operations
+		return fmt.Sprintf("%s %s, %s", thumbALUOps[(op>>6)&0xf], thumbRegNames[rd], thumbRegNames[rs]), 2
+
+	case op&0xfc00 == 0x4400:
+		// hi register operations/branch exchange
+		hd := rd | (op>>4)&0x8
+		hs := (op >> 3) & 0xf
+		switch (op >> 8) & 0x3 {
+		case 0:
+			return fmt.Sprintf("add %s, %s", thumbRegNames[hd], thumbRegNames[hs]), 2
+		case 1:
+			return fmt.Sprintf("cmp %s, %s", thumbRegNames[hd], thumbRegNames[hs]), 2
+		case 2:
+			return fmt.Sprintf("mov %s, %s", thumbRegNames[hd], thumbRegNames[hs]), 2
+		default:
+			return fmt.Sprintf("bx %s", thumbRegNames[hs]), 2
+		}
+
+	case op&0xf800 == 0x4800:
+		// pc-relative load
+		target := (addr+4)&^3 + uint32(op&0xff)*4
+		return fmt.Sprintf("ldr %s, [pc, #0x%x] ; =0x%08x", thumbRegNames[(op>>8)&0x7], uint32(op&0xff)*4, target), 2
+
+	case op&0xf200 == 0x5000:
+		// load/store with register offset
+		mnemonic := [4]string{"str", "strb", "ldr", "ldrb"}[(op>>10)&0x3]
+		return fmt.Sprintf("%s %s, [%s, %s]", mnemonic, thumbRegNames[rd], thumbRegNames[rs], thumbRegNames[(op>>6)&0x7]), 2
+
+	case op&0xf200 == 0x5200:
+		// load/store sign-extended byte/halfword
+		mnemonic := [4]string{"strh", "ldsb", "ldrh", "ldsh"}[(op>>10)&0x3]
+		return fmt.Sprintf("%s %s, [%s, %s]", mnemonic, thumbRegNames[rd], thumbRegNames[rs], thumbRegNames[(op>>6)&0x7]), 2
+
+	case op&0xe000 == 0x6000:
+		// load/store with immediate offset
+		offset := uint32((op >> 6) & 0x1f)
+		mnemonic := [4]string{"str", "ldr", "strb", "ldrb"}[(op>>11)&0x3]
+		if op&0x1000 == 0 {
+			offset *= 4
+		}
+		return fmt.Sprintf("%s %s, [%s, #0x%x]", mnemonic, thumbRegNames[rd], thumbRegNames[rs], offset), 2
+
+	case op&0xf000 == 0x8000:
+		// load/store halfword
+		mnemonic := "strh"
+		if op&0x0800 != 0 {
+			mnemonic = "ldrh"
+		}
+		return fmt.Sprintf("%s %s, [%s, #0x%x]", mnemonic, thumbRegNames[rd], thumbRegNames[rs], uint32((op>>6)&0x1f)*2), 2
+
+	case op&0xf000 == 0x9000:
+		// sp-relative load/store
+		mnemonic := "str"
+		if op&0x0800 != 0 {
+			mnemonic = "ldr"
+		}
+		return fmt.Sprintf("%s %s, [sp, #0x%x]", mnemonic, thumbRegNames[(op>>8)&0x7], uint32(op&0xff)*4), 2
+
+	case op&0xf000 == 0xa000:
+		// load address
+		base := "pc"
+		if op&0x0800 != 0 {
+			base = "sp"
+		}
+		return fmt.Sprintf("add %s, %s, #0x%x", thumbRegNames[(op>>8)&0x7], base, uint32(op&0xff)*4), 2
+
+	case op&0xff00 == 0xb000:
+		// add offset to stack pointer
+		if op&0x0080 != 0 {
+			return fmt.Sprintf("sub sp, #0x%x", uint32(op&0x7f)*4), 2
+		}
+		return fmt.Sprintf("add sp, #0x%x", uint32(op&0x7f)*4), 2
+
+	case op&0xf600 == 0xb400:
+		// push/pop registers
+		if op&0x0800 != 0 {
+			extra := ""
+			if op&0x0100 != 0 {
+				extra = "pc"
+			}
+			return "pop " + thumbRegList(op&0xff, extra), 2
+		}
+		extra := ""
+		if op&0x0100 != 0 {
+			extra = "lr"
+		}
+		return "push " + thumbRegList(op&0xff, extra), 2
+
+	case op&0xff00 == 0xbe00:
+		return fmt.Sprintf("bkpt 0x%02x", op&0xff), 2
+
+	case op&0xf000 == 0xc000:
+		// multiple load/store
+		mnemonic := "stmia"
+		if op&0x0800 != 0 {
+			mnemonic = "ldmia"
+		}
+		return fmt.Sprintf("%s %s!, %s", mnemonic, thumbRegNames[(op>>8)&0x7], thumbRegList(op&0xff, "")), 2
+
+	case op&0xff00 == 0xdf00:
+		return fmt.Sprintf("swi 0x%02x", op&0xff), 2
+
+	case op&0xf000 == 0xd000:
+		// conditional branch
+		cond := (op >> 8) & 0xf
+		if cond == 0xe {
+			break
+		}
+		target := addr + 4 + uint32(signExtend(uint32(op&0xff), 8)*2)
+		return fmt.Sprintf("b%s 0x%08x", thumbCondNames[cond], target), 2
+
+	case op&0xf800 == 0xe000:
+		// unconditional branch
+		target := addr + 4 + uint32(signExtend(uint32(op&0x7ff), 11)*2)
+		return fmt.Sprintf("b 0x%08x", target), 2
+
+	case op&0xf800 == 0xf000:
+		// long branch with link, which is always a pair of instructions
+		if next&0xf800 != 0xf800 {
+			break
+		}
+		offset := signExtend(uint32(op&0x7ff), 11)<<12 | int32(next&0x7ff)<<1
+		return fmt.Sprintf("bl 0x%08x", addr+4+uint32(offset)), 4
+	}
+
+	return fmt.Sprintf(".hword 0x%04x", op), 2
+}
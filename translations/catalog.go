@@ -39,26 +39,31 @@ func init() {
 }
 
 var messageKeyToIndex = map[string]int{
+	"COMMIT_NETPLAY_SAVE":    2,
 	"ENTER_MATCHMAKING_CODE": 1,
 	"SELECT_ROM":             0,
 }
 
-var en_USIndex = []uint32{ // 3 elements
-	0x00000000, 0x0000008d, 0x000000e4,
-} // Size: 36 bytes
+var en_USIndex = []uint32{ // 4 elements
+	0x00000000, 0x0000008d, 0x000000e4, 0x0000015e,
+} // Size: 40 bytes
 
-const en_USData string = "" + // Size: 228 bytes
+const en_USData string = "" + // Size: 350 bytes
 	"\x02Select a game to start below.\x0a\x0aIf the list is empty, remember " +
 	"to put your ROMs in the \x22roms\x22 directory (and saves in the \x22sav" +
 	"es\x22 directory)!\x02Enter a link code that you and your opponent have " +
-	"decided on to connect to each other:"
+	"decided on to connect to each other:\x02Your save was changed during net" +
+	"play. Keep the changes?\x0a\x0aIf you don't, your save will be left as i" +
+	"t was before the match."
 
-var ja_JPIndex = []uint32{ // 3 elements
-	0x00000000, 0x000000ed, 0x00000169,
-} // Size: 36 bytes
+var ja_JPIndex = []uint32{ // 4 elements
+	0x00000000, 0x000000ed, 0x00000169, 0x00000229,
+} // Size: 40 bytes
 
-const ja_JPData string = "" + // Size: 361 bytes
+const ja_JPData string = "" + // Size: 553 bytes
 	"\x02下記より開始するゲームを選択してください。\x0a\x0a以下のリストが空の場合は、「roms」ディレクトリにROMファイルを、「sav" +
-	"es」ディレクトリにセーブファイルを置いてください。\x02お互いに接続するために、あなたと相手が決めたリンクコードを以下に入力してください。"
+	"es」ディレクトリにセーブファイルを置いてください。\x02お互いに接続するために、あなたと相手が決めたリンクコードを以下に入力してください。" +
+	"\x02ネットプレイ中にセーブデータが変更されました。変更を保存しますか？\x0a\x0a保存しない場合、セーブデータは対戦前の状態のままになり" +
+	"ます。"
 
-	// Total table size 661 bytes (0KiB); checksum: E23BDC73
+	// Total table size 983 bytes (0KiB); checksum: 138C0B56
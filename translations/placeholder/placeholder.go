@@ -10,4 +10,5 @@ func placeholder() {
 	p := message.NewPrinter(language.AmericanEnglish)
 	p.Printf("SELECT_ROM")
 	p.Printf("ENTER_MATCHMAKING_CODE")
+	p.Printf("COMMIT_NETPLAY_SAVE")
 }